@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// requestIDHeader carries the ID of each request back to the client, so that
+// a failure someone reports can be found in the logs. If a reverse proxy in
+// front of us already set one, we use it.
+const requestIDHeader = "X-Request-Id"
+
+var requestIDP = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestInfo is what the access log learns about a request while it's being
+// served
+type requestInfo struct {
+	id   string
+	user string
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom gives the requestInfo of a request, or nil if it's not
+// going through an access log
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return ri
+}
+
+// accessLog writes a line for every request we serve, either as JSON or in
+// Common Log Format. Lines in Common Log Format have the request ID and the
+// number of seconds the request took added to the end.
+type accessLog struct {
+	format string // "json" or "clf"
+
+	// healthChecks says whether to log requests for /healthz and /readyz
+	healthChecks bool
+
+	mu sync.Mutex
+	w  io.Writer // nil if the log is off
+}
+
+// accessEntry is a line of the access log in JSON format
+type accessEntry struct {
+	Time      time.Time
+	RequestID string
+	Remote    string
+	User      string `json:",omitempty"`
+	Method    string
+	Host      string
+	URI       string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Seconds   float64
+	UserAgent string `json:",omitempty"`
+}
+
+// openAccessLog opens an access log. The destination is a file to append to,
+// "-" for stdout, or "off".
+func openAccessLog(dest, format string) (*accessLog, error) {
+	if format != "json" && format != "clf" {
+		return nil, fmt.Errorf("unknown access log format %q: expected json or clf", format)
+	}
+	l := &accessLog{format: format}
+	switch dest {
+	case "off":
+	case "", "-":
+		l.w = os.Stdout
+	default:
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		onShutdown(f.Close)
+		l.w = f
+	}
+	return l, nil
+}
+
+// wrap gives a handler that assigns each request an ID and logs it after
+// next has served it
+func (l *accessLog) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ri := &requestInfo{id: r.Header.Get(requestIDHeader)}
+		if !requestIDP.MatchString(ri.id) {
+			ri.id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, ri.id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, ri)))
+
+		if l == nil || l.w == nil || (isHealthCheck(r) && !l.healthChecks) {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		l.write(accessEntry{
+			Time:      start.UTC(),
+			RequestID: ri.id,
+			Remote:    remoteHost(r),
+			User:      ri.user,
+			Method:    r.Method,
+			Host:      r.Host,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			Seconds:   time.Since(start).Seconds(),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
+
+func (l *accessLog) write(e accessEntry) {
+	var line []byte
+	if l.format == "json" {
+		b, err := json.Marshal(e)
+		if err != nil {
+			log_error.Printf("unable to write access log: %v", err)
+			return
+		}
+		line = append(b, '\n')
+	} else {
+		user := e.User
+		if user == "" {
+			user = "-"
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] %q %d %d %s %.6f\n",
+			e.Remote, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.URI+" "+e.Proto, e.Status, e.Bytes, e.RequestID, e.Seconds))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		log_error.Printf("unable to write access log: %v", err)
+	}
+}
+
+// remoteHost gives the address a request came from, without the port
+func remoteHost(r *http.Request) string {
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "unix"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// requestPrefix gives a prefix for log lines about the response being written
+// to w, so that they can be matched up with the access log
+func requestPrefix(w http.ResponseWriter) string {
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
+
+// setRequestUser records who made a request, for the access log
+func setRequestUser(r *http.Request, user string) {
+	if ri := requestInfoFrom(r.Context()); ri != nil {
+		ri.user = user
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := &accessLog{format: "json", w: &buf}
+	h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRequestUser(r, "jordan")
+		writeError(w, apiError(http.StatusTeapot))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/dl/orel.li/mir/@v/list", nil))
+
+	id := rec.Header().Get(requestIDHeader)
+	if id == "" {
+		t.Fatal("expected a request ID header")
+	}
+
+	var e accessEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("bad access log line %q: %v", buf.String(), err)
+	}
+	if e.RequestID != id || e.User != "jordan" || e.Status != http.StatusTeapot || e.Bytes != int64(rec.Body.Len()) {
+		t.Errorf("unexpected access log entry %+v", e)
+	}
+	if e.URI != "/dl/orel.li/mir/@v/list" {
+		t.Errorf("expected the request URI to be logged, saw %q", e.URI)
+	}
+
+	// a request ID from a proxy in front of us is kept
+	buf.Reset()
+	l.format = "clf"
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(requestIDHeader, "from-the-proxy")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if got := rec.Header().Get(requestIDHeader); got != "from-the-proxy" {
+		t.Errorf("expected the proxy's request ID, saw %q", got)
+	}
+	if !strings.Contains(buf.String(), `"GET / HTTP/1.1" 418`) || !strings.Contains(buf.String(), " from-the-proxy ") {
+		t.Errorf("unexpected common log format line %q", buf.String())
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// accessList says which users may do what to which modules. It's read from a
+// file with one rule per line, like this:
+//
+//	# the infra group
+//	group infra alice bob
+//
+//	# who may publish where
+//	publish @infra orel.li/infra/...
+//	publish jordan orel.li/...
+//
+//	# who may download what
+//	read authenticated orel.li/private/...
+//	read @infra,carol orel.li/infra/secret/...
+//
+// A rule applies to a comma-separated list of usernames and @groups. Module
+// patterns ending in /... match that path and every path beneath it; other
+// patterns match a single module path.
+//
+// Everybody may publish nowhere and download everything, except where a rule
+// says otherwise. For downloads, only the most specific matching read rule
+// counts, so a module can be made public again beneath a private prefix with
+// "read public".
+type accessList struct {
+	groups  map[string][]string
+	publish []grant
+	read    []grant
+}
+
+// grant gives a set of users access to modules matching a set of patterns
+type grant struct {
+	who      []string // usernames and @groups
+	patterns []string
+}
+
+// loadAccessList reads an access list from a file
+func loadAccessList(fname string) (*accessList, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl, err := parseAccessList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return acl, nil
+}
+
+func parseAccessList(r io.Reader) (*accessList, error) {
+	acl := accessList{groups: make(map[string][]string)}
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "group":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: group needs a name", lineno)
+			}
+			acl.groups[fields[1]] = append(acl.groups[fields[1]], fields[2:]...)
+		case "publish":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: publish needs users and module patterns", lineno)
+			}
+			acl.publish = append(acl.publish, grant{
+				who:      strings.Split(fields[1], ","),
+				patterns: fields[2:],
+			})
+		case "read":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: read needs public, authenticated, or users, and module patterns", lineno)
+			}
+			acl.read = append(acl.read, grant{
+				who:      strings.Split(fields[1], ","),
+				patterns: fields[2:],
+			})
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q", lineno, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// catch typos in group names, which would otherwise silently grant
+	// nothing to anybody
+	for _, g := range append(acl.publish, acl.read...) {
+		for _, who := range g.who {
+			if name := strings.TrimPrefix(who, "@"); name != who && acl.groups[name] == nil {
+				return nil, fmt.Errorf("undefined group %s", who)
+			}
+		}
+	}
+	return &acl, nil
+}
+
+// checkPublish checks whether a user may publish to a module path. Without an
+// access list, every user may publish everywhere.
+func (a *accessList) checkPublish(user, modpath string) error {
+	if a == nil {
+		return nil
+	}
+	for _, g := range a.publish {
+		if a.includes(g.who, user) && matchAny(g.patterns, modpath) {
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s may not publish to %s: %w", user, modpath, apiError(http.StatusForbidden))
+}
+
+// checkRead checks whether a user may download a module. The user is empty
+// for requests that didn't authenticate, and authenticate is only called for
+// modules that need it, since checking passwords isn't cheap.
+func (a *accessList) checkRead(modpath string, authenticate func() (string, error)) error {
+	rule := a.readRule(modpath)
+	if rule == nil || rule.who[0] == "public" {
+		return nil
+	}
+
+	user, err := authenticate()
+	if err != nil {
+		return err
+	}
+	if rule.who[0] == "authenticated" || a.includes(rule.who, user) {
+		return nil
+	}
+	return fmt.Errorf("user %s may not read %s: %w", user, modpath, apiError(http.StatusForbidden))
+}
+
+// public checks whether anybody at all may download a module
+func (a *accessList) public(modpath string) bool {
+	rule := a.readRule(modpath)
+	return rule == nil || rule.who[0] == "public"
+}
+
+// readRule finds the most specific read rule that matches a module path. A
+// pattern that matches the module path exactly is more specific than a
+// /... pattern with the same prefix.
+func (a *accessList) readRule(modpath string) *grant {
+	if a == nil {
+		return nil
+	}
+
+	var (
+		best  *grant
+		score = -1
+	)
+	for i, g := range a.read {
+		for _, p := range g.patterns {
+			if !matchPattern(p, modpath) {
+				continue
+			}
+			// trim the same suffix as matchPattern, so that a /...
+			// pattern scores one less than the exact pattern for its prefix
+			prefix := strings.TrimSuffix(p, "/...")
+			n := 2*len(prefix) + 1
+			if prefix != p {
+				n--
+			}
+			if p == "..." {
+				n = 0
+			}
+			if n > score {
+				best, score = &a.read[i], n
+			}
+		}
+	}
+	return best
+}
+
+// includes checks whether a list of usernames and @groups includes a user
+func (a *accessList) includes(who []string, user string) bool {
+	for _, w := range who {
+		if w == user {
+			return true
+		}
+		if strings.HasPrefix(w, "@") {
+			for _, member := range a.groups[w[1:]] {
+				if member == user {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchAny checks whether a module path matches any of a list of patterns
+func matchAny(patterns []string, modpath string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, modpath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern checks whether a module path matches a pattern. A pattern
+// ending in /... matches its prefix and every path beneath it, and ... on its
+// own matches everything.
+func matchPattern(pattern, modpath string) bool {
+	if pattern == "..." {
+		return true
+	}
+	if prefix := strings.TrimSuffix(pattern, "/..."); prefix != pattern {
+		return modpath == prefix || strings.HasPrefix(modpath, prefix+"/")
+	}
+	return modpath == pattern
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	acl, err := parseAccessList(strings.NewReader(`
+# the infra group
+group infra alice bob
+
+publish @infra orel.li/infra/...
+publish jordan ...
+publish carol,dave orel.li/tools orel.li/lib/...
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		user    string
+		modpath string
+		ok      bool
+	}{
+		{"alice", "orel.li/infra", true},
+		{"alice", "orel.li/infra/dns/v2", true},
+		{"bob", "orel.li/infra/dns", true},
+		{"alice", "orel.li/infrastructure", false},
+		{"alice", "orel.li/mir", false},
+		{"jordan", "orel.li/mir", true},
+		{"carol", "orel.li/tools", true},
+		{"dave", "orel.li/tools/sub", false},
+		{"dave", "orel.li/lib/x", true},
+		{"mallory", "orel.li/infra", false},
+	}
+
+	for _, tt := range tests {
+		err := acl.checkPublish(tt.user, tt.modpath)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkPublish(%q, %q) = %v, expected ok: %v", tt.user, tt.modpath, err, tt.ok)
+		}
+	}
+
+	var none *accessList
+	if err := none.checkPublish("anybody", "orel.li/anything"); err != nil {
+		t.Errorf("expected no access list to allow everything, saw %v", err)
+	}
+}
+
+func TestAccessListErrors(t *testing.T) {
+	bad := []string{
+		"publish alice",
+		"publish @nobody orel.li/...",
+		"allow alice orel.li/...",
+		"group",
+	}
+	for _, text := range bad {
+		if _, err := parseAccessList(strings.NewReader(text)); err == nil {
+			t.Errorf("expected an error parsing %q", text)
+		}
+	}
+}
+
+func TestAccessListRead(t *testing.T) {
+	acl, err := parseAccessList(strings.NewReader(`
+group infra alice bob
+
+read authenticated orel.li/private/...
+read public orel.li/private/open
+read @infra,carol orel.li/private/infra/...
+read alice orel.li/m/...
+read public orel.li/m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		user    string
+		modpath string
+		status  int
+	}{
+		{"", "orel.li/mir", 0},
+		{"", "orel.li/private", http.StatusUnauthorized},
+		{"mallory", "orel.li/private/x", 0},
+		{"", "orel.li/private/open", 0},
+		{"", "orel.li/private/open/v2", http.StatusUnauthorized},
+		{"", "orel.li/private/infra/dns", http.StatusUnauthorized},
+		{"mallory", "orel.li/private/infra/dns", http.StatusForbidden},
+		{"alice", "orel.li/private/infra/dns", 0},
+		{"carol", "orel.li/private/infra", 0},
+		{"", "orel.li/m", 0},
+		{"", "orel.li/m/sub", http.StatusUnauthorized},
+		{"alice", "orel.li/m/sub", 0},
+	}
+
+	for _, tt := range tests {
+		authenticate := func() (string, error) {
+			if tt.user == "" {
+				return "", apiError(http.StatusUnauthorized)
+			}
+			return tt.user, nil
+		}
+		err := acl.checkRead(tt.modpath, authenticate)
+		var status apiError
+		errors.As(err, &status)
+		if int(status) != tt.status {
+			t.Errorf("checkRead(%q) as %q = %v, expected status %d", tt.modpath, tt.user, err, tt.status)
+		}
+	}
+}
+
+func TestPrivateDownload(t *testing.T) {
+	h := testHandler(t)
+	addVersion(t, h, "orel.li/private/x", "v1.0.0", "")
+	h.acl, _ = parseAccessList(strings.NewReader("read authenticated orel.li/private/..."))
+
+	rec := get(h, "/dl/orel.li/private/x/@v/list")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, saw %d", rec.Code)
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("expected a WWW-Authenticate header on 401")
+	}
+}
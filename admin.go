@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// yankInfo is what we keep in the .yanked file of a yanked version
+type yankInfo struct {
+	User   string
+	Time   time.Time
+	Reason string `json:",omitempty"`
+}
+
+// auditEntry is a line in the audit log, which records every change that
+// anybody makes to a published version
+type auditEntry struct {
+	Time    time.Time
+	User    string
+	Action  string
+	Path    string
+	Version string
+	Reason  string `json:",omitempty"`
+}
+
+// trash is the store that deleted versions are moved into
+func (h handler) trash() store {
+	return store{dir: filepath.Join(h.root, "trash")}
+}
+
+// admin serves the /admin/$module/@v/$version/$action endpoints, which change
+// the state of a version that has already been published:
+//
+//	yank    - hide the version from @v/list and @latest, but keep serving it
+//	delete  - move the version into the trash, so it isn't served at all
+//	restore - undo a yank, or bring a deleted version back out of the trash
+func (h handler) admin(modpath, modversion, action string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, apiError(http.StatusMethodNotAllowed))
+		return
+	}
+
+	user, err := h.authenticate(r, scopePublish, modpath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// anybody who could have published a version can take it back
+	if err := h.acl.checkPublish(user, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// a delete or restore moves the files of a version around, which
+	// mustn't happen in the middle of an upload of it
+	if action == "delete" || action == "restore" {
+		release, err := h.claimVersion(modpath, modversion)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer release()
+	}
+
+	reason := r.FormValue("reason")
+	switch action {
+	case "yank":
+		err = h.yank(modpath, modversion, yankInfo{User: user, Time: time.Now().UTC(), Reason: reason})
+	case "delete":
+		err = moveVersion(h.modules(), h.trash(), modpath, modversion)
+	case "restore":
+		err = h.restore(modpath, modversion)
+	default:
+		err = apiError(http.StatusNotFound)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log_info.Printf("%s %s@%s by %s", action, modpath, modversion, user)
+	err = h.audit(auditEntry{
+		Time:    time.Now().UTC(),
+		User:    user,
+		Action:  action,
+		Path:    modpath,
+		Version: modversion,
+		Reason:  reason,
+	})
+	if err != nil {
+		writeError(w, fmt.Errorf("%s done, but unable to write audit log: %w", action, err))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// yank marks a published version as yanked
+func (h handler) yank(modpath, version string, y yankInfo) error {
+	zipfile, err := h.zipPath(modpath, version)
+	if err != nil {
+		return err
+	}
+	if missing(zipfile) {
+		return apiError(http.StatusNotFound)
+	}
+
+	fname, err := h.modules().file(modpath, version, ".yanked")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(y)
+	if err != nil {
+		return err
+	}
+	return writeFile(fname, b)
+}
+
+// restore brings a deleted version back out of the trash, or un-yanks a
+// yanked version
+func (h handler) restore(modpath, version string) error {
+	trashed, err := h.trash().file(modpath, version, ".zip")
+	if err != nil {
+		return err
+	}
+	if !missing(trashed) {
+		return moveVersion(h.trash(), h.modules(), modpath, version)
+	}
+
+	fname, err := h.modules().file(modpath, version, ".yanked")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fname); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s@%s is neither deleted nor yanked: %w", modpath, version, apiError(http.StatusNotFound))
+		}
+		return err
+	}
+	return nil
+}
+
+// audit appends an entry to the audit log
+func (h handler) audit(e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(h.root, "audit.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// yanked checks whether a stored version has been yanked
+func (s store) yanked(modpath, version string) bool {
+	fname, err := s.file(modpath, version, ".yanked")
+	if err != nil {
+		return false
+	}
+	return !missing(fname)
+}
+
+// listed gives the versions of a module that show up in @v/list and @latest,
+// which is all of them except for the ones that have been yanked
+func (s store) listed(modpath string) ([]string, error) {
+	versions, err := s.versions(modpath)
+	if err != nil {
+		return nil, err
+	}
+	keep := versions[:0]
+	for _, v := range versions {
+		if !s.yanked(modpath, v) {
+			keep = append(keep, v)
+		}
+	}
+	if len(keep) == 0 {
+		return nil, apiError(http.StatusNotFound)
+	}
+	return keep, nil
+}
+
+// admincmd is the client side of the admin endpoints, e.g.
+//
+//	mir yank -server https://orel.li -user jordan orel.li/mir@v0.1.0
+//
+// The password, or an API token, is read from MIR_PASSWORD if it's set, or
+// from the terminal if not.
+func admincmd(action string, args []string) {
+	var (
+		server = os.Getenv("MIR_SERVER")
+		user   = os.Getenv("USER")
+		reason string
+	)
+
+	flags := flag.NewFlagSet(action, flag.ExitOnError)
+	flags.StringVar(&server, "server", server, "base url of the mir server (default $MIR_SERVER)")
+	flags.StringVar(&user, "user", user, "username to authenticate as")
+	flags.StringVar(&reason, "reason", "", "reason for the change, for the audit log")
+	flags.Parse(args)
+
+	if server == "" {
+		bail(1, "a server url is required")
+	}
+
+	target := flags.Arg(0)
+	i := strings.LastIndex(target, "@")
+	if i < 0 {
+		bail(1, "expected module@version, saw %q", target)
+	}
+	modpath, version := target[:i], target[i+1:]
+	if err := module.Check(modpath, version); err != nil {
+		bail(1, "bad module version: %v", err)
+	}
+	escPath, _ := module.EscapePath(modpath)
+	escVersion, _ := module.EscapeVersion(version)
+
+	pass, ok := os.LookupEnv("MIR_PASSWORD")
+	if !ok {
+		var err error
+		pass, err = readPassword(fmt.Sprintf("password for %s: ", user))
+		if err != nil {
+			bail(1, "%v", err)
+		}
+	}
+
+	u := strings.TrimSuffix(server, "/") + fmt.Sprintf("/admin/%s/@v/%s/%s", escPath, escVersion, action)
+	req, err := http.NewRequest("POST", u, strings.NewReader(url.Values{"reason": {reason}}.Encode()))
+	if err != nil {
+		bail(1, "bad request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(user, pass)
+
+	log_debug.Printf("POST %s", u)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		bail(1, "request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		bail(1, "%s failed: %s: %s", action, res.Status, body)
+	}
+	log_info.Printf("%s %s: %s", action, target, body)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// adminAction posts an admin action for a module version as alice
+func adminAction(h handler, modpath, version, action string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/"+modpath+"/@v/"+version+"/"+action, nil)
+	r.SetBasicAuth("alice", "hunter2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestDeletedVersionCannotBeUploadedAgain(t *testing.T) {
+	h := uploadHandler(t)
+	if w := upload(h, "orel.li/x", "v1.0.0", moduleZip(t, "orel.li/x", "v1.0.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	if w := adminAction(h, "orel.li/x", "v1.0.0", "delete"); w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body)
+	}
+
+	different := moduleZipFiles(t, "orel.li/x", "v1.0.0", map[string]string{
+		"go.mod": "module orel.li/x\n",
+		"b.go":   "package x\n",
+	})
+	if w := upload(h, "orel.li/x", "v1.0.0", different); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 uploading a deleted version again, got %d: %s", w.Code, w.Body)
+	}
+	if w := adminAction(h, "orel.li/x", "v1.0.0", "restore"); w.Code != http.StatusOK {
+		t.Errorf("expected the deleted version to be restored, got %d: %s", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/orel.li/x/@v/v1.0.0.zip"); w.Code != http.StatusOK {
+		t.Errorf("expected the restored version to be served, got %d", w.Code)
+	}
+}
+
+func TestAdminWaitsForUploads(t *testing.T) {
+	h := uploadHandler(t)
+	if w := upload(h, "orel.li/x", "v1.0.0", moduleZip(t, "orel.li/x", "v1.0.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	release, err := h.claimVersion("orel.li/x", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"delete", "restore"} {
+		if w := adminAction(h, "orel.li/x", "v1.0.0", action); w.Code != http.StatusConflict {
+			t.Errorf("expected 409 for a %s during an upload, got %d", action, w.Code)
+		}
+	}
+	release()
+
+	if w := adminAction(h, "orel.li/x", "v1.0.0", "delete"); w.Code != http.StatusOK {
+		t.Errorf("expected the delete to work once the upload is done, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestYankDeleteRestore(t *testing.T) {
+	h := uploadHandler(t)
+	for _, version := range []string{"v1.0.0", "v1.1.0"} {
+		if w := upload(h, "orel.li/x", version, moduleZip(t, "orel.li/x", version)); w.Code != http.StatusOK {
+			t.Fatalf("upload of %s failed: %d %s", version, w.Code, w.Body)
+		}
+	}
+
+	// a yanked version is hidden, but anybody who already has it can still
+	// download it
+	if w := adminAction(h, "orel.li/x", "v1.1.0", "yank"); w.Code != http.StatusOK {
+		t.Fatalf("yank failed: %d %s", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/orel.li/x/@v/list"); w.Body.String() != "v1.0.0\n" {
+		t.Errorf("expected the yanked version to be left out of the list, got %q", w.Body)
+	}
+	if w := get(h, "/dl/orel.li/x/@latest"); !strings.Contains(w.Body.String(), `"v1.0.0"`) {
+		t.Errorf("expected @latest to skip the yanked version, got %s", w.Body)
+	}
+	if w := get(h, "/dl/orel.li/x/@v/v1.1.0.zip"); w.Code != http.StatusOK {
+		t.Errorf("expected the yanked zip to still be served, got %d", w.Code)
+	}
+	if w := adminAction(h, "orel.li/x", "v1.1.0", "restore"); w.Code != http.StatusOK {
+		t.Fatalf("restore failed: %d %s", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/orel.li/x/@v/list"); w.Body.String() != "v1.0.0\nv1.1.0\n" {
+		t.Errorf("expected the restored version to be listed, got %q", w.Body)
+	}
+
+	if w := adminAction(h, "orel.li/x", "v1.1.0", "delete"); w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body)
+	}
+	for _, ext := range []string{".zip", ".info", ".mod"} {
+		if w := get(h, "/dl/orel.li/x/@v/v1.1.0"+ext); w.Code != http.StatusNotFound {
+			t.Errorf("expected the deleted %s to be gone, got %d", ext, w.Code)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(h.root, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad audit log line %q: %v", line, err)
+		}
+		if e.User != "alice" || e.Path != "orel.li/x" || e.Version != "v1.1.0" {
+			t.Errorf("expected alice's actions on orel.li/x@v1.1.0, got %+v", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, " "); got != "yank restore delete" {
+		t.Errorf("expected every action in the audit log, got %q", got)
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	h := uploadHandler(t)
+	if w := upload(h, "orel.li/x", "v1.0.0", moduleZip(t, "orel.li/x", "v1.0.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/orel.li/x/@v/v1.0.0/yank", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a login, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/admin/orel.li/x/@v/v1.0.0/yank", nil)
+	r.SetBasicAuth("alice", "hunter2")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for a GET, got %d", w.Code)
+	}
+
+	for _, tt := range []struct {
+		version, action string
+		code            int
+	}{
+		{"v1.0.0", "destroy", http.StatusNotFound},
+		{"v1.1.0", "yank", http.StatusNotFound},
+		{"v1.1.0", "delete", http.StatusNotFound},
+		{"v1.0.0", "restore", http.StatusNotFound},
+		{"latest", "yank", http.StatusBadRequest},
+	} {
+		if w := adminAction(h, "orel.li/x", tt.version, tt.action); w.Code != tt.code {
+			t.Errorf("%s of %s: expected %d, got %d: %s", tt.action, tt.version, tt.code, w.Code, w.Body)
+		}
+	}
+
+	acl, err := parseAccessList(strings.NewReader("publish alice orel.li/y/...\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.acl = acl
+	if w := adminAction(h, "orel.li/x", "v1.0.0", "yank"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 yanking somewhere alice can't publish, got %d", w.Code)
+	}
+	if w := get(h, "/dl/orel.li/x/@v/list"); w.Body.String() != "v1.0.0\n" {
+		t.Errorf("expected every failed action to leave the version alone, got %q", w.Body)
+	}
+}
+
+func TestYankedLatestRetractions(t *testing.T) {
+	h := uploadHandler(t)
+	for version, gomod := range map[string]string{
+		"v1.0.0": "module orel.li/x\n",
+		"v1.1.0": "module orel.li/x\n",
+		"v1.2.0": "module orel.li/x\n\nretract v1.1.0 // broken build\n",
+	} {
+		zip := moduleZipFiles(t, "orel.li/x", version, map[string]string{"go.mod": gomod, "x.go": "package x\n"})
+		if w := upload(h, "orel.li/x", version, zip); w.Code != http.StatusOK {
+			t.Fatalf("upload of %s failed: %d %s", version, w.Code, w.Body)
+		}
+	}
+	if w := adminAction(h, "orel.li/x", "v1.2.0", "yank"); w.Code != http.StatusOK {
+		t.Fatalf("yank failed: %d %s", w.Code, w.Body)
+	}
+
+	// with v1.2.0 yanked, the go command sees v1.1.0 as the latest version,
+	// and its go.mod doesn't retract anything
+	for _, path := range []string{"/dl/orel.li/x/@latest", "/dl/orel.li/x/@v/v1.1.0.info"} {
+		var info moduleInfo
+		w := get(h, path)
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatalf("%s: bad info: %d %v", path, w.Code, err)
+		}
+		if info.Version != "v1.1.0" || info.Retracted != nil {
+			t.Errorf("%s: expected v1.1.0 without retractions, got %+v", path, info)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authenticate checks the credentials on a request against our users and API
+// tokens, giving the name of the user that made the request. A token is
+// accepted as a bearer token or in place of a basic auth password, and only
+// for the scope and module it was created for.
+func (h handler) authenticate(r *http.Request, scope, modpath string) (string, error) {
+	// locking out usernames only makes sense for passwords, since a token
+	// can be sent with any username
+	ip, name := remoteHost(r), ""
+	kind := credentialKind(r)
+	if kind == "password" {
+		name, _, _ = r.BasicAuth()
+	}
+	if err := h.limits.checkLockout(ip, name); err != nil {
+		return "", err
+	}
+
+	user, err := h.credentials(r, scope, modpath)
+	if err != nil {
+		var status apiError
+		if errors.As(err, &status) && status == http.StatusUnauthorized {
+			authFailures.inc(kind)
+			if kind != "none" {
+				h.limits.authFailed(ip, name)
+			}
+		}
+		return "", err
+	}
+	h.limits.authSucceeded(name)
+	setRequestUser(r, user)
+	return user, nil
+}
+
+// credentialKind says what sort of credentials a request has, to label
+// metrics with
+func credentialKind(r *http.Request) string {
+	if _, ok := bearerToken(r); ok {
+		return "token"
+	}
+	_, pass, ok := r.BasicAuth()
+	switch {
+	case !ok:
+		return "none"
+	case strings.HasPrefix(pass, tokenPrefix):
+		return "token"
+	}
+	return "password"
+}
+
+// credentials does the work of authenticate
+func (h handler) credentials(r *http.Request, scope, modpath string) (string, error) {
+	if token, ok := bearerToken(r); ok {
+		return h.authenticateToken(token, scope, modpath)
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", apiError(http.StatusUnauthorized)
+	}
+	if strings.HasPrefix(pass, tokenPrefix) {
+		return h.authenticateToken(pass, scope, modpath)
+	}
+
+	hash := h.users.hash(user)
+	if hash == "" {
+		hash = h.auth[user]
+	}
+	if hash == "" {
+		return "", apiError(http.StatusUnauthorized)
+	}
+
+	start := time.Now()
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	bcryptDuration.since(start)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", err, apiError(http.StatusUnauthorized))
+	}
+	return user, nil
+}
+
+// authenticateToken checks an API token, giving the name of the user it
+// belongs to
+func (h handler) authenticateToken(token, scope, modpath string) (string, error) {
+	t, ok, err := h.tokens.lookup(token)
+	if err != nil {
+		return "", fmt.Errorf("unable to read tokens: %w", err)
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown token: %w", apiError(http.StatusUnauthorized))
+	}
+	if err := t.allows(scope, modpath, time.Now()); err != nil {
+		return "", err
+	}
+	return t.User, nil
+}
+
+// bearerToken gives the bearer token in a request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	a := r.Header.Get("Authorization")
+	if len(a) < len(prefix) || !strings.EqualFold(a[:len(prefix)], prefix) {
+		return "", false
+	}
+	return a[len(prefix):], true
+}
+
+// authorizeRead checks that a request may download a module
+func (h handler) authorizeRead(r *http.Request, modpath string) error {
+	return h.acl.checkRead(modpath, func() (string, error) {
+		return h.authenticate(r, scopeRead, modpath)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// backfillcmd writes the .info, .mod and .sums files for versions that were
+// uploaded before we started writing them at upload time, and the publish log
+// if there isn't one yet. The only timestamp we have for those is the
+// modification time of the zip, so run this before anything else gets a
+// chance to touch them.
+func backfillcmd(args []string) {
+	var (
+		rootDir = "/srv/mir"
+		dryRun  bool
+	)
+
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	flags.StringVar(&rootDir, "root", rootDir, "root directory for module storage")
+	flags.BoolVar(&dryRun, "n", false, "print what would be written without writing anything")
+	flags.Parse(args)
+
+	modules := store{dir: filepath.Join(rootDir, "modules")}
+	paths, err := modules.modules()
+	if err != nil {
+		bail(1, "unable to scan module directory: %v", err)
+	}
+
+	var failed int
+	for _, modpath := range paths {
+		versions, err := modules.versions(modpath)
+		if err != nil {
+			log_error.Printf("unable to list versions of %s: %v", modpath, err)
+			failed++
+			continue
+		}
+		for _, version := range versions {
+			if err := backfillVersion(modules, modpath, version, dryRun); err != nil {
+				log_error.Printf("unable to backfill %s@%s: %v", modpath, version, err)
+				failed++
+			}
+		}
+	}
+
+	if err := backfillPublishLog(rootDir, modules, dryRun); err != nil {
+		log_error.Printf("unable to backfill the publish log: %v", err)
+		failed++
+	}
+
+	if failed > 0 {
+		bail(1, "backfill finished with %d errors", failed)
+	}
+}
+
+// backfillVersion writes whichever of the .info, .mod and .sums files are
+// missing for a single module version
+func backfillVersion(modules store, modpath, version string, dryRun bool) error {
+	zipfile, err := modules.file(modpath, version, ".zip")
+	if err != nil {
+		return err
+	}
+
+	infofile, err := modules.file(modpath, version, ".info")
+	if err != nil {
+		return err
+	}
+	if missing(infofile) {
+		fi, err := os.Stat(zipfile)
+		if err != nil {
+			return err
+		}
+		info := moduleInfo{Version: version, Time: fi.ModTime().UTC()}
+		log_info.Printf("%s@%s: writing %s with time %v", modpath, version, infofile, info.Time)
+		if !dryRun {
+			if err := modules.writeInfo(modpath, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	modfile, err := modules.file(modpath, version, ".mod")
+	if err != nil {
+		return err
+	}
+	if missing(modfile) {
+		b, err := zipGoMod(zipfile, modpath, version)
+		if err != nil {
+			return err
+		}
+		log_info.Printf("%s@%s: writing %s", modpath, version, modfile)
+		if !dryRun {
+			if err := modules.writeMod(modpath, version, b); err != nil {
+				return err
+			}
+		}
+	}
+
+	sumsfile, err := modules.file(modpath, version, ".sums")
+	if err != nil {
+		return err
+	}
+	if missing(sumsfile) {
+		sums, err := modules.hashVersion(modpath, version)
+		if err != nil {
+			return err
+		}
+		log_info.Printf("%s@%s: writing %s with hash %s", modpath, version, sumsfile, sums.Hash)
+		if !dryRun {
+			if err := modules.writeSums(*sums); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// missing checks whether nothing exists at a given path
+func missing(fname string) bool {
+	_, err := os.Stat(fname)
+	return errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileEntry is a line in the file tree of a module version
+type fileEntry struct {
+	Name  string
+	Depth int
+	Dir   bool
+	Size  uint64
+}
+
+// browseIndex serves the list of every module we host that the client may
+// see
+func (h handler) browseIndex(w http.ResponseWriter, r *http.Request) {
+	s := h.modules()
+	paths, err := s.modules()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sort.Strings(paths)
+
+	readable := h.canRead(r)
+	data := browseIndexData{Hostname: h.hostname}
+	for _, modpath := range paths {
+		if !readable(modpath) {
+			continue
+		}
+		versions, err := s.listed(modpath)
+		if err != nil {
+			continue
+		}
+		m := browseModule{Path: modpath, Latest: latestVersion(versions)}
+		if info, err := s.readInfo(modpath, m.Latest); err == nil {
+			m.Time = info.Time
+		}
+		data.Modules = append(data.Modules, m)
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=60, must-revalidate")
+	h.renderPage(w, r, "index", data)
+}
+
+// browseModule serves the page for a module, with every version we have of
+// it, including the yanked ones
+func (h handler) browseModule(modpath string, w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s := h.modules()
+	versions, err := s.versions(modpath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	retracted, err := s.retractions(modpath, versions)
+	if err != nil {
+		log_error.Printf("unable to read retractions for %s: %v", modpath, err)
+	}
+
+	data := browseModuleData{Hostname: h.hostname, Path: modpath}
+	for i := len(versions) - 1; i >= 0; i-- {
+		data.Versions = append(data.Versions, h.browseVersion(modpath, versions[i], retracted))
+	}
+
+	latest := latestVersion(versions)
+	if listed, err := s.listed(modpath); err == nil {
+		latest = latestVersion(retracted.filter(listed))
+		if latest == "" {
+			latest = latestVersion(listed)
+		}
+	}
+	data.GoGet = h.goGetCommand(modpath, latest)
+	if gomod, err := s.readMod(modpath, latest); err == nil {
+		data.GoMod = string(gomod)
+	}
+
+	h.setCacheControl(w, modpath, false)
+	h.renderPage(w, r, "module", data)
+}
+
+// browseVersionPage serves the page for a single version of a module, with
+// the files in its zip
+func (h handler) browseVersionPage(modpath, version string, w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s := h.modules()
+	fname, err := s.file(modpath, version, ".zip")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	files, err := zipTree(fname, modpath, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	versions, err := s.versions(modpath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	retracted, err := s.retractions(modpath, versions)
+	if err != nil {
+		log_error.Printf("unable to read retractions for %s: %v", modpath, err)
+	}
+
+	h.setCacheControl(w, modpath, false)
+	h.renderPage(w, r, "version", browseVersionData{
+		Hostname:      h.hostname,
+		Path:          modpath,
+		GoGet:         h.goGetCommand(modpath, version),
+		browseVersion: h.browseVersion(modpath, version, retracted),
+		Files:         files,
+	})
+}
+
+// browseVersion gathers what the pages show about a version
+func (h handler) browseVersion(modpath, version string, retracted retractions) browseVersion {
+	s := h.modules()
+	v := browseVersion{
+		Version:   version,
+		Retracted: retracted.rationale(version),
+		Yanked:    s.yanked(modpath, version),
+	}
+	if info, err := s.readInfo(modpath, version); err == nil {
+		v.Time = info.Time
+	}
+	return v
+}
+
+// goGetCommand gives the command to copy and paste to use a module version.
+// Modules under our own hostname are found through the go-get page, but
+// anything else needs GOPROXY pointed at us.
+func (h handler) goGetCommand(modpath, version string) string {
+	cmd := fmt.Sprintf("go get %s@%s", modpath, version)
+	if modpath != h.hostname && !strings.HasPrefix(modpath, h.hostname+"/") {
+		cmd = fmt.Sprintf("GOPROXY=https://%s/dl %s", h.hostname, cmd)
+	}
+	return cmd
+}
+
+// renderPage renders one of the browse pages into a buffer first, so that a
+// template error is reported as an error rather than half a page
+func (h handler) renderPage(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := browsePages.ExecuteTemplate(&buf, name, data); err != nil {
+		writeError(w, fmt.Errorf("unable to render %s page: %w", name, err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	serveBytes(w, r, time.Time{}, buf.Bytes())
+}
+
+// canRead gives a function that checks whether the client that made a
+// request may download a module. It never asks for credentials, since a page
+// listing many modules shouldn't fail because a few of them are private, and
+// a password is only checked once no matter how many modules need it.
+func (h handler) canRead(r *http.Request) func(modpath string) bool {
+	kind := credentialKind(r)
+	var (
+		checked bool
+		user    string
+		err     error
+	)
+	return func(modpath string) bool {
+		return h.acl.checkRead(modpath, func() (string, error) {
+			switch kind {
+			case "none":
+				return "", apiError(http.StatusUnauthorized)
+			case "password":
+				if !checked {
+					user, err = h.authenticate(r, scopeRead, modpath)
+					checked = true
+				}
+				return user, err
+			}
+			// tokens can be limited to some modules, but they're cheap to
+			// check
+			return h.authenticate(r, scopeRead, modpath)
+		}) == nil
+	}
+}
+
+// zipTree lists the files in a module zip as a tree, with each directory
+// before the files in it
+func zipTree(fname, modpath, version string) ([]fileEntry, error) {
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	prefix := modpath + "@" + version + "/"
+	files := make([]*zip.File, 0, len(zr.File))
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, prefix) && !strings.HasSuffix(f.Name, "/") {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return treeLess(files[i].Name, files[j].Name)
+	})
+
+	var (
+		entries []fileEntry
+		open    []string // the directories we're inside of
+	)
+	for _, f := range files {
+		name := strings.TrimPrefix(f.Name, prefix)
+		dirs := strings.Split(path.Dir(name), "/")
+		if dirs[0] == "." {
+			dirs = nil
+		}
+		same := 0
+		for same < len(open) && same < len(dirs) && open[same] == dirs[same] {
+			same++
+		}
+		for i := same; i < len(dirs); i++ {
+			entries = append(entries, fileEntry{Name: dirs[i], Depth: i, Dir: true})
+		}
+		open = dirs
+		entries = append(entries, fileEntry{Name: path.Base(name), Depth: len(dirs), Size: f.UncompressedSize64})
+	}
+	return entries, nil
+}
+
+// treeLess orders file paths so that the files in a directory come before
+// its subdirectories
+func treeLess(a, b string) bool {
+	da, db := treeDir(a), treeDir(b)
+	switch {
+	case da == db:
+		return a < b
+	case strings.HasPrefix(db, da):
+		return true
+	case strings.HasPrefix(da, db):
+		return false
+	}
+	return da < db
+}
+
+// treeDir gives the directory of a file path with a trailing slash, or
+// nothing for files at the root
+func treeDir(p string) string {
+	if d := path.Dir(p); d != "." {
+		return d + "/"
+	}
+	return ""
+}
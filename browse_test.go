@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/zip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBrowse(t *testing.T) {
+	h := uploadHandler(t)
+	for _, v := range []string{"v1.0.0", "v1.1.0"} {
+		if w := upload(h, "orel.li/browse", v, moduleZip(t, "orel.li/browse", v)); w.Code != http.StatusOK {
+			t.Fatalf("upload of %s failed: %d %s", v, w.Code, w.Body)
+		}
+	}
+	if w := upload(h, "example.com/!other", "v0.1.0", moduleZip(t, "example.com/Other", "v0.1.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/dl/", []string{
+			`<a href="/dl/orel.li/browse/">orel.li/browse</a>`,
+			`<a href="/dl/example.com/!other/">example.com/Other</a>`,
+			"v1.1.0",
+		}},
+		{"/dl/orel.li/browse/", []string{
+			"go get orel.li/browse@v1.1.0",
+			`<a href="/dl/orel.li/browse/@v/v1.0.0/">v1.0.0</a>`,
+			"module orel.li/browse\n",
+		}},
+		{"/dl/example.com/!other/", []string{
+			"GOPROXY=https://orel.li/dl go get example.com/Other@v0.1.0",
+		}},
+		{"/dl/orel.li/browse/@v/v1.0.0/", []string{
+			"go get orel.li/browse@v1.0.0",
+			"a.go",
+			`href="/dl/orel.li/browse/@v/v1.0.0.zip"`,
+		}},
+	}
+	for _, test := range tests {
+		w := get(h, test.path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d: %s", test.path, w.Code, w.Body)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("%s: expected html, got %q", test.path, ct)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: expected page to contain %q", test.path, want)
+			}
+		}
+	}
+
+	if w := get(h, "/dl/orel.li/browse/@v/v1.9.0/"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing version, got %d", w.Code)
+	}
+}
+
+func TestBrowsePrivate(t *testing.T) {
+	h := uploadHandler(t)
+	for _, modpath := range []string{"orel.li/open", "orel.li/secret"} {
+		if w := upload(h, modpath, "v1.0.0", moduleZip(t, modpath, "v1.0.0")); w.Code != http.StatusOK {
+			t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+		}
+	}
+	acl, err := parseAccessList(strings.NewReader("read authenticated orel.li/secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.acl = acl
+
+	index := get(h, "/dl/").Body.String()
+	if !strings.Contains(index, "orel.li/open") || strings.Contains(index, "orel.li/secret") {
+		t.Errorf("expected only the public module in the index, got:\n%s", index)
+	}
+	if w := get(h, "/dl/orel.li/secret/"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a private module page, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/dl/", nil)
+	r.SetBasicAuth("alice", "hunter2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "orel.li/secret") {
+		t.Errorf("expected the private module in the index once logged in, got:\n%s", w.Body)
+	}
+}
+
+func TestZipTree(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "m.zip")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"b/z/c.go", "go.mod", "b/b.go", "a.go", "b.c/d.go"} {
+		fw, err := zw.Create("orel.li/m@v1.0.0/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("x"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	entries, err := zipTree(fname, "orel.li/m", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, strings.Repeat("  ", e.Depth)+e.Name)
+	}
+	want := []string{"a.go", "go.mod", "b.c", "  d.go", "b", "  b.go", "  z", "    c.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected tree %q, got %q", want, got)
+	}
+}
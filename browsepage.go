@@ -0,0 +1,139 @@
+package main
+
+import (
+	"html/template"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// the pages people see when they point a browser at /dl/
+
+type browseIndexData struct {
+	Hostname string
+	Modules  []browseModule
+}
+
+type browseModule struct {
+	Path   string
+	Latest string
+	Time   time.Time
+}
+
+type browseModuleData struct {
+	Hostname string
+	Path     string
+	GoGet    string
+	GoMod    string // the go.mod of the latest version
+	Versions []browseVersion
+}
+
+type browseVersion struct {
+	Version   string
+	Time      time.Time
+	Retracted []string
+	Yanked    bool
+}
+
+type browseVersionData struct {
+	Hostname string
+	Path     string
+	GoGet    string
+	browseVersion
+	Files []fileEntry
+}
+
+var browseFuncs = template.FuncMap{
+	"escpath": func(modpath string) (string, error) {
+		return module.EscapePath(modpath)
+	},
+	"escversion": func(version string) (string, error) {
+		return module.EscapeVersion(version)
+	},
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04 MST")
+	},
+	"indent": func(depth int) int {
+		return 1 + 2*depth
+	},
+}
+
+var browsePages = template.Must(template.New("browse").Funcs(browseFuncs).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; }
+pre, code { background: #f4f4f4; }
+pre { padding: 0.5em; overflow-x: auto; }
+table { border-collapse: collapse; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+.note { color: #a00; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "header" .Hostname}}
+<h1>{{.Hostname}}</h1>
+{{if .Modules}}
+<table>
+<tr><th>module</th><th>latest</th><th>published</th></tr>
+{{range .Modules}}<tr>
+<td><a href="/dl/{{escpath .Path}}/">{{.Path}}</a></td>
+<td>{{.Latest}}</td>
+<td>{{date .Time}}</td>
+</tr>
+{{end}}</table>
+{{else}}
+<p>No modules here yet.</p>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "module"}}{{template "header" .Path}}
+<p><a href="/dl/">{{.Hostname}}</a></p>
+<h1>{{.Path}}</h1>
+<pre>{{.GoGet}}</pre>
+<h2>Versions</h2>
+<table>
+{{range .Versions}}<tr>
+<td><a href="/dl/{{escpath $.Path}}/@v/{{escversion .Version}}/">{{.Version}}</a></td>
+<td>{{date .Time}}</td>
+<td class="note">{{if .Yanked}}yanked {{end}}{{range .Retracted}}retracted: {{.}} {{end}}</td>
+</tr>
+{{end}}</table>
+<h2>go.mod</h2>
+<pre>{{.GoMod}}</pre>
+{{template "footer"}}{{end}}
+
+{{define "version"}}{{template "header" (printf "%s@%s" .Path .Version)}}
+<p><a href="/dl/">{{.Hostname}}</a> / <a href="/dl/{{escpath .Path}}/">{{.Path}}</a></p>
+<h1>{{.Path}} {{.Version}}</h1>
+<p>Published {{date .Time}}</p>
+{{if .Yanked}}<p class="note">This version has been yanked.</p>{{end}}
+{{range .Retracted}}<p class="note">Retracted: {{.}}</p>{{end}}
+<pre>{{.GoGet}}</pre>
+<p>
+<a href="/dl/{{escpath .Path}}/@v/{{escversion .Version}}.zip">zip</a>
+<a href="/dl/{{escpath .Path}}/@v/{{escversion .Version}}.mod">go.mod</a>
+<a href="/dl/{{escpath .Path}}/@v/{{escversion .Version}}.info">info</a>
+<a href="/doc/{{escpath .Path}}@{{escversion .Version}}/">docs</a>
+</p>
+<h2>Files</h2>
+<table>
+{{range .Files}}<tr>
+<td style="padding-left: {{indent .Depth}}em">{{.Name}}{{if .Dir}}/{{end}}</td>
+<td>{{if not .Dir}}{{.Size}}{{end}}</td>
+</tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+`))
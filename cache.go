@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// setCacheControl sets the Cache-Control header of a response about a module.
+// A version's zip and go.mod never change once it's published, so caches
+// may keep them forever. Anything that changes as versions are published,
+// yanked, or retracted has to be checked again after a short while. Modules
+// that need a login to download are only ever cached privately, so that a
+// shared cache never hands them to somebody else.
+func (h handler) setCacheControl(w http.ResponseWriter, modpath string, immutable bool) {
+	scope := "public"
+	if !h.acl.public(modpath) {
+		scope = "private"
+	}
+	if immutable {
+		w.Header().Set("Cache-Control", scope+", max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", scope+", max-age=60, must-revalidate")
+	}
+}
+
+// etag formats a hash as a strong ETag
+func etag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// serveBytes serves a response body with http.ServeContent, which takes care
+// of HEAD, Range, and conditional requests. Without an ETag already set, the
+// body gets one from its own hash.
+func serveBytes(w http.ResponseWriter, r *http.Request, modtime time.Time, b []byte) {
+	if w.Header().Get("ETag") == "" {
+		sum := sha256.Sum256(b)
+		w.Header().Set("ETag", etag(base64.RawURLEncoding.EncodeToString(sum[:16])))
+	}
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(b))
+}
+
+// serveJSON serves a value as JSON with serveBytes
+func serveJSON(w http.ResponseWriter, r *http.Request, modtime time.Time, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	serveBytes(w, r, modtime, append(b, '\n'))
+}
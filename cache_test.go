@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCacheHeaders(t *testing.T) {
+	h := uploadHandler(t)
+	body := moduleZip(t, "orel.li/cache", "v1.0.0")
+	if w := upload(h, "orel.li/cache", "v1.0.0", body); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		path    string
+		control string
+	}{
+		{"/dl/orel.li/cache/@v/v1.0.0.zip", "public, max-age=31536000, immutable"},
+		{"/dl/orel.li/cache/@v/v1.0.0.mod", "public, max-age=31536000, immutable"},
+		{"/dl/orel.li/cache/@v/v1.0.0.info", "public, max-age=60, must-revalidate"},
+		{"/dl/orel.li/cache/@v/list", "public, max-age=60, must-revalidate"},
+		{"/dl/orel.li/cache/@latest", "public, max-age=60, must-revalidate"},
+	}
+	for _, test := range tests {
+		w := get(h, test.path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", test.path, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Cache-Control"); got != test.control {
+			t.Errorf("%s: expected Cache-Control %q, got %q", test.path, test.control, got)
+		}
+		tag := w.Header().Get("ETag")
+		if !strings.HasPrefix(tag, `"`) {
+			t.Errorf("%s: expected a strong ETag, got %q", test.path, tag)
+			continue
+		}
+
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("If-None-Match", tag)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s: expected 304 for a matching ETag, got %d", test.path, rec.Code)
+		}
+	}
+
+	zip := get(h, "/dl/orel.li/cache/@v/v1.0.0.zip")
+	if tag := zip.Header().Get("ETag"); !strings.HasPrefix(tag, `"h1:`) {
+		t.Errorf("expected the zip's ETag to be its h1 hash, got %q", tag)
+	}
+	if zip.Header().Get("Last-Modified") == "" {
+		t.Error("expected the zip to have a Last-Modified time")
+	}
+
+	r := httptest.NewRequest("GET", "/dl/orel.li/cache/@v/v1.0.0.zip", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != string(body[:4]) {
+		t.Errorf("expected the first 4 bytes of the zip, got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestPrivateCacheControl(t *testing.T) {
+	h := uploadHandler(t)
+	if w := upload(h, "orel.li/secret", "v1.0.0", moduleZip(t, "orel.li/secret", "v1.0.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	acl, err := parseAccessList(strings.NewReader("read authenticated orel.li/secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.acl = acl
+
+	r := httptest.NewRequest("GET", "/dl/orel.li/secret/@v/v1.0.0.zip", nil)
+	r.SetBasicAuth("alice", "hunter2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Cache-Control"); !strings.HasPrefix(got, "private,") {
+		t.Errorf("expected a private Cache-Control, got %q", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For headers we
+// believe. "unix" stands for anything that reaches us over the unix socket.
+type trustedProxies struct {
+	unix bool
+	nets []*net.IPNet
+}
+
+// parseTrustedProxies parses a comma-separated list of addresses, networks in
+// CIDR notation, and "unix"
+func parseTrustedProxies(s string) (*trustedProxies, error) {
+	t := new(trustedProxies)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case entry == "unix":
+			t.unix = true
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("bad trusted proxy %q: %w", entry, err)
+			}
+			t.nets = append(t.nets, n)
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return t, nil
+}
+
+// trusts checks whether an address, as remoteHost gives it, is a proxy we
+// trust
+func (t *trustedProxies) trusts(addr string) bool {
+	if t == nil {
+		return false
+	}
+	if addr == "unix" {
+		return t.unix
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr gives the address of the client that made a request. When the
+// request came through proxies we trust, that's the last address in
+// X-Forwarded-For that isn't one of them.
+func (t *trustedProxies) clientAddr(r *http.Request) string {
+	addr := remoteHost(r)
+	if !t.trusts(addr) {
+		return addr
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(h, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		addr = hops[i]
+		if !t.trusts(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// wrap gives a handler that replaces the remote address of each request with
+// the address of the client, so that everything after it, the access log and
+// the rate limits included, sees the client instead of the proxy
+func (t *trustedProxies) wrap(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = t.clientAddr(r)
+		next.ServeHTTP(w, r)
+	})
+}
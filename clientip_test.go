@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies("unix,10.0.0.0/8,192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		remote string
+		xff    string
+		client string
+	}{
+		{"198.51.100.1:1234", "", "198.51.100.1"},
+		{"198.51.100.1:1234", "203.0.113.9", "198.51.100.1"},
+		{"10.1.2.3:1234", "203.0.113.9", "203.0.113.9"},
+		{"192.0.2.7:1234", "203.0.113.9, 10.0.0.1", "203.0.113.9"},
+		{"192.0.2.7:1234", "1.2.3.4, 203.0.113.9, 10.0.0.1", "203.0.113.9"},
+		{"@", "203.0.113.9", "203.0.113.9"},
+		{"@", "", "unix"},
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := proxies.clientAddr(r); got != tt.client {
+			t.Errorf("clientAddr from %s with X-Forwarded-For %q = %s, expected %s", tt.remote, tt.xff, got, tt.client)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected a bad network to be an error")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// serveConfig is everything that mir serve can be configured with. It can be
+// read from a JSON file with -config, with every field optional:
+//
+//	{
+//		"Root": "/srv/mir",
+//		"Hostname": "orel.li",
+//		"Listen": {"Unix": "/run/mir/mir.sock"},
+//		"Auth": {"UsersFile": "/etc/mir/users"},
+//		"ACL": {"File": "/etc/mir/acl"},
+//		"Upstream": {"Proxies": "https://proxy.golang.org"},
+//		"SumDB": {"KeyFile": "/etc/mir/sumdb.key"}
+//	}
+//
+// Flags given to mir serve override what's in the file.
+type serveConfig struct {
+	// Root is the root directory for module storage
+	Root string
+
+	// Hostname is the domain name on which we serve modules
+	Hostname string
+
+	Listen    listenConfig
+	TLS       tlsConfig
+	Auth      authConfig
+	ACL       aclConfig
+	Upstream  upstreamConfig
+	SumDB     sumdbConfig
+	AccessLog accessLogConfig
+	Metrics   metricsConfig
+	Health    healthConfig
+	Limits    limitsConfig
+}
+
+// listenConfig says where we listen. Exactly one of these is required.
+type listenConfig struct {
+	HTTP string `json:",omitempty"` // tcp address
+	Unix string `json:",omitempty"` // unix domain socket path
+
+	// TrustedProxies are the reverse proxies in front of us whose
+	// X-Forwarded-For headers we believe: a comma-separated list of
+	// addresses, CIDR networks, and "unix" for the unix socket
+	TrustedProxies string `json:",omitempty"`
+}
+
+// tlsConfig turns on TLS for our listener when both files are given
+type tlsConfig struct {
+	CertFile string `json:",omitempty"`
+	KeyFile  string `json:",omitempty"`
+}
+
+type authConfig struct {
+	// UsersFile is an htpasswd-style file of usernames and password hashes
+	UsersFile string `json:",omitempty"`
+}
+
+type aclConfig struct {
+	// File is the access list of who may publish and download what
+	File string `json:",omitempty"`
+}
+
+type upstreamConfig struct {
+	// Proxies are where we fetch modules that we don't host, in GOPROXY
+	// syntax
+	Proxies string `json:",omitempty"`
+}
+
+type sumdbConfig struct {
+	// KeyFile is a signing key from mir sumdb-keygen. We only run a
+	// checksum database if there is one.
+	KeyFile string `json:",omitempty"`
+}
+
+type accessLogConfig struct {
+	// File is where the access log goes: a file to append to, "-" for
+	// stdout, or "off"
+	File string
+
+	// Format is json or clf, for Common Log Format
+	Format string
+
+	// HealthChecks says whether to log requests for /healthz and /readyz
+	HealthChecks bool `json:",omitempty"`
+}
+
+type metricsConfig struct {
+	// Listen is where /metrics is served: an address for a listener of its
+	// own, empty for the same listener as everything else, or "off"
+	Listen string `json:",omitempty"`
+}
+
+type healthConfig struct {
+	// MinFreeMB is how much free disk space, in megabytes, /readyz wants
+	// there to be under the root. Zero turns the check off.
+	MinFreeMB uint64
+
+	// DrainDelay is how long /readyz fails for during shutdown before we
+	// stop serving, as a duration like "10s"
+	DrainDelay string `json:",omitempty"`
+}
+
+// limitsConfig says how much each client may do. Zero turns a limit off.
+type limitsConfig struct {
+	// UploadsPerMinute and UploadBurst set the token bucket that uploads
+	// from each client address and each user come out of
+	UploadsPerMinute float64
+	UploadBurst      int
+
+	// MaxConcurrentUploads caps how many uploads run at once
+	MaxConcurrentUploads int
+
+	// LockoutFailures failed logins in a row from one address or for one
+	// user lock it out for LockoutDuration, a duration like "15m"
+	LockoutFailures int
+	LockoutDuration string `json:",omitempty"`
+}
+
+func defaultConfig() serveConfig {
+	return serveConfig{
+		Root:      "/srv/mir",
+		AccessLog: accessLogConfig{File: "-", Format: "clf"},
+		Health:    healthConfig{MinFreeMB: 100},
+		Limits: limitsConfig{
+			UploadsPerMinute:     30,
+			UploadBurst:          10,
+			MaxConcurrentUploads: 4,
+			LockoutFailures:      10,
+			LockoutDuration:      "15m",
+		},
+	}
+}
+
+// flags defines a flag for each setting, storing into c
+func (c *serveConfig) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen.Unix, "unix", c.Listen.Unix, "path for a unix domain socket to listen on")
+	fs.StringVar(&c.Listen.HTTP, "http", c.Listen.HTTP, "http address to listen on")
+	fs.StringVar(&c.Root, "root", c.Root, "root directory for module storage")
+	fs.StringVar(&c.Hostname, "hostname", c.Hostname, "domain name on which mir serves modules")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "path to a TLS certificate, to serve https")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "path to the key for -tls-cert")
+	fs.StringVar(&c.Auth.UsersFile, "users-file", c.Auth.UsersFile, "path to an htpasswd-style file of usernames and bcrypt password hashes")
+	fs.StringVar(&c.Upstream.Proxies, "upstream", c.Upstream.Proxies, "module proxies to fetch modules we don't host from, in GOPROXY syntax")
+	fs.StringVar(&c.SumDB.KeyFile, "sumdb-key", c.SumDB.KeyFile, "path to a signing key from mir sumdb-keygen, to serve a checksum database")
+	fs.StringVar(&c.ACL.File, "acl-file", c.ACL.File, "path to a file of rules for which users may publish and download which modules")
+	fs.StringVar(&c.AccessLog.File, "access-log", c.AccessLog.File, `where to write the access log: a file, "-" for stdout, or "off"`)
+	fs.StringVar(&c.AccessLog.Format, "access-log-format", c.AccessLog.Format, "access log format: json or clf")
+	fs.BoolVar(&c.AccessLog.HealthChecks, "access-log-health-checks", c.AccessLog.HealthChecks, "log requests for /healthz and /readyz")
+	fs.Uint64Var(&c.Health.MinFreeMB, "min-free-mb", c.Health.MinFreeMB, "free disk space, in megabytes, below which /readyz fails")
+	fs.StringVar(&c.Health.DrainDelay, "drain-delay", c.Health.DrainDelay, "how long /readyz fails before the server stops, when shutting down")
+	fs.StringVar(&c.Listen.TrustedProxies, "trusted-proxies", c.Listen.TrustedProxies, `comma-separated addresses, networks, and "unix" whose X-Forwarded-For we believe`)
+	fs.Float64Var(&c.Limits.UploadsPerMinute, "uploads-per-minute", c.Limits.UploadsPerMinute, "uploads allowed per minute from each address and each user")
+	fs.IntVar(&c.Limits.UploadBurst, "upload-burst", c.Limits.UploadBurst, "uploads allowed at once before -uploads-per-minute applies")
+	fs.IntVar(&c.Limits.MaxConcurrentUploads, "max-concurrent-uploads", c.Limits.MaxConcurrentUploads, "uploads allowed to run at the same time")
+	fs.IntVar(&c.Limits.LockoutFailures, "lockout-failures", c.Limits.LockoutFailures, "failed logins in a row before an address or user is locked out")
+	fs.StringVar(&c.Limits.LockoutDuration, "lockout-duration", c.Limits.LockoutDuration, "how long a lockout lasts")
+	fs.StringVar(&c.Metrics.Listen, "metrics-http", c.Metrics.Listen, `address to serve /metrics on, instead of the main listener, or "off"; on the main listener, private modules are left out`)
+}
+
+// loadConfig reads a config file on top of the defaults
+func loadConfig(fname string) (serveConfig, error) {
+	c := defaultConfig()
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return c, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %w", fname, err)
+	}
+	return c, nil
+}
+
+// parseServeFlags reads the config file named by -config, if any, and then
+// applies every flag that was set on the command line on top of it
+func parseServeFlags(name string, args []string) (serveConfig, authUsers) {
+	var (
+		c          = defaultConfig()
+		auth       = make(authUsers)
+		configFile string
+	)
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&configFile, "config", configFile, "path to a JSON config file; flags override its settings")
+	fs.Var(&auth, "auth-users", "comma-separated list of usernames and bcrypt password hashes (deprecated: use -users-file)")
+	c.flags(fs)
+	fs.Parse(args)
+
+	if configFile == "" {
+		return c, auth
+	}
+
+	fc, err := loadConfig(configFile)
+	if err != nil {
+		bail(1, "unable to read config: %v", err)
+	}
+	overrides := flag.NewFlagSet(name, flag.ContinueOnError)
+	fc.flags(overrides)
+	fs.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) != nil {
+			overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	return fc, auth
+}
+
+// limits builds the limits a config asks for. It expects a config that has
+// been checked.
+func (c serveConfig) limits() *limits {
+	l := new(limits)
+	if c.Limits.UploadsPerMinute > 0 {
+		l.uploads = newRateLimiter(c.Limits.UploadsPerMinute, c.Limits.UploadBurst)
+	}
+	if c.Limits.MaxConcurrentUploads > 0 {
+		l.uploadSlots = make(chan struct{}, c.Limits.MaxConcurrentUploads)
+	}
+	if c.Limits.LockoutFailures > 0 {
+		d, _ := time.ParseDuration(c.Limits.LockoutDuration)
+		l.lockout = newLockout(c.Limits.LockoutFailures, d)
+	}
+	return l
+}
+
+// check checks that a configuration makes sense and that every file it
+// names can be read, without starting anything
+func (c serveConfig) check() error {
+	var errs []string
+	fail := func(err error) { errs = append(errs, err.Error()) }
+
+	if c.Root == "" {
+		fail(errors.New("a root directory is required"))
+	}
+	if c.Hostname == "" {
+		fail(errors.New("a hostname is required"))
+	}
+	if (c.Listen.HTTP == "") == (c.Listen.Unix == "") {
+		fail(errors.New("exactly one of an http address or a unix socket is required"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail(errors.New("TLS needs both a certificate and a key"))
+	} else if c.TLS.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			fail(fmt.Errorf("unable to read TLS certificate: %w", err))
+		}
+	}
+	if c.Auth.UsersFile != "" {
+		if _, err := readUsers(c.Auth.UsersFile); err != nil {
+			fail(fmt.Errorf("unable to read users: %w", err))
+		}
+	}
+	if c.ACL.File != "" {
+		if _, err := loadAccessList(c.ACL.File); err != nil {
+			fail(fmt.Errorf("unable to read access list: %w", err))
+		}
+	}
+	var proxies proxyList
+	if err := proxies.Set(c.Upstream.Proxies); err != nil {
+		fail(fmt.Errorf("bad upstream: %w", err))
+	}
+	if c.SumDB.KeyFile != "" {
+		if _, err := readSigner(c.SumDB.KeyFile); err != nil {
+			fail(fmt.Errorf("unable to read checksum database key: %w", err))
+		}
+	}
+	if f := c.AccessLog.Format; f != "json" && f != "clf" {
+		fail(fmt.Errorf("unknown access log format %q: expected json or clf", f))
+	}
+	if c.Health.DrainDelay != "" {
+		if _, err := time.ParseDuration(c.Health.DrainDelay); err != nil {
+			fail(fmt.Errorf("bad drain delay: %w", err))
+		}
+	}
+	if _, err := parseTrustedProxies(c.Listen.TrustedProxies); err != nil {
+		fail(err)
+	}
+	if c.Limits.LockoutFailures > 0 {
+		if _, err := time.ParseDuration(c.Limits.LockoutDuration); err != nil {
+			fail(fmt.Errorf("bad lockout duration: %w", err))
+		}
+	}
+	if c.Limits.UploadsPerMinute > 0 && c.Limits.UploadBurst < 1 {
+		fail(errors.New("an upload rate needs an upload burst of at least 1"))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// configcmd works with config files, e.g.
+//
+//	mir config check -config /etc/mir/mir.json
+//
+// check takes the same flags as mir serve, and prints the configuration that
+// mir serve would run with.
+func configcmd(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		bail(1, "usage: mir config check -config file [serve flags]")
+	}
+
+	c, _ := parseServeFlags("config check", args[1:])
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		bail(1, "%v", err)
+	}
+	fmt.Println(string(b))
+	if err := c.check(); err != nil {
+		bail(1, "bad config:\n%v", err)
+	}
+}
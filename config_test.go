@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFlagsOverrideFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "mir.json")
+	text := `{
+		"Root": "/var/mir",
+		"Hostname": "orel.li",
+		"Listen": {"Unix": "/run/mir.sock"},
+		"Upstream": {"Proxies": "https://proxy.golang.org"}
+	}`
+	if err := os.WriteFile(fname, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := parseServeFlags("serve", []string{"-config", fname, "-hostname", "example.com", "-upstream", ""})
+	if c.Root != "/var/mir" {
+		t.Errorf("expected the file's root, saw %q", c.Root)
+	}
+	if c.Listen.Unix != "/run/mir.sock" {
+		t.Errorf("expected the file's socket, saw %q", c.Listen.Unix)
+	}
+	if c.Hostname != "example.com" {
+		t.Errorf("expected the flag to override the hostname, saw %q", c.Hostname)
+	}
+	if c.Upstream.Proxies != "" {
+		t.Errorf("expected the flag to clear the upstream, saw %q", c.Upstream.Proxies)
+	}
+	if err := c.check(); err != nil {
+		t.Errorf("expected a good config, saw %v", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "mir.json")
+	if err := os.WriteFile(fname, []byte(`{"Hostnme": "orel.li"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(fname); err == nil {
+		t.Error("expected an unknown setting to be an error")
+	}
+
+	bad := []serveConfig{
+		{Root: "/srv/mir", Listen: listenConfig{HTTP: ":8080"}},
+		{Root: "/srv/mir", Hostname: "orel.li"},
+		{Root: "/srv/mir", Hostname: "orel.li", Listen: listenConfig{HTTP: ":8080", Unix: "/run/mir.sock"}},
+		{Root: "/srv/mir", Hostname: "orel.li", Listen: listenConfig{HTTP: ":8080"}, TLS: tlsConfig{CertFile: "cert.pem"}},
+		{Root: "/srv/mir", Hostname: "orel.li", Listen: listenConfig{HTTP: ":8080"}, Upstream: upstreamConfig{Proxies: "direct"}},
+		{Root: "/srv/mir", Hostname: "orel.li", Listen: listenConfig{HTTP: ":8080"}, ACL: aclConfig{File: "/nonexistent"}},
+	}
+	for _, c := range bad {
+		if err := c.check(); err == nil {
+			t.Errorf("expected an error checking %+v", c)
+		}
+	}
+}
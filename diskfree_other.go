@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// diskFree isn't implemented here, so the free disk space check in /readyz
+// is skipped
+func diskFree(dir string) (uint64, error) {
+	return 0, errDiskFreeUnsupported
+}
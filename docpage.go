@@ -0,0 +1,56 @@
+package main
+
+import (
+	"html/template"
+)
+
+type docPageData struct {
+	Hostname string
+	Path     string
+	Version  string
+	Package  *docPackage // nil for a module root without a package
+
+	// Packages are the other packages in the module, listed on the docs for
+	// the module root
+	Packages []*docPackage
+}
+
+var _ = template.Must(browsePages.New("package").Parse(`{{template "header" (printf "%s@%s" .Path .Version)}}
+<p><a href="/dl/">{{.Hostname}}</a> / <a href="/dl/{{escpath .Path}}/">{{.Path}}</a> / <a href="/dl/{{escpath .Path}}/@v/{{escversion .Version}}/">{{.Version}}</a></p>
+{{with .Package}}
+<h1>package {{.Name}}</h1>
+<pre>import "{{.ImportPath}}"</pre>
+{{.Doc}}
+{{if .Consts}}<h2>Constants</h2>{{range .Consts}}{{template "value" .}}{{end}}{{end}}
+{{if .Vars}}<h2>Variables</h2>{{range .Vars}}{{template "value" .}}{{end}}{{end}}
+{{range .Funcs}}{{template "func" .}}{{end}}
+{{range .Types}}
+<h2 id="{{.Name}}">type {{.Name}}</h2>
+<pre>{{.Decl}}</pre>
+{{.Doc}}
+{{range .Consts}}{{template "value" .}}{{end}}
+{{range .Vars}}{{template "value" .}}{{end}}
+{{range .Funcs}}{{template "func" .}}{{end}}
+{{range .Methods}}{{template "func" .}}{{end}}
+{{end}}
+{{else}}
+<h1>{{.Path}}</h1>
+{{end}}
+{{if .Packages}}
+<h2>Packages</h2>
+<table>
+{{range .Packages}}<tr>
+<td><a href="/doc/{{escpath $.Path}}@{{escversion $.Version}}/{{.Dir}}">{{.Dir}}</a></td>
+<td>{{.Synopsis}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+{{template "footer"}}
+{{- define "value"}}<pre>{{.Decl}}</pre>
+{{.Doc}}
+{{end}}
+{{- define "func"}}<h3 id="{{.ID}}">{{.Name}}</h3>
+<pre>{{.Decl}}</pre>
+{{.Doc}}
+{{end -}}
+`))
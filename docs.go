@@ -0,0 +1,418 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// maxDocSource is the largest Go file we'll parse for documentation
+const maxDocSource = 4 << 20
+
+// docCache holds the rendered documentation for every module version that
+// somebody has looked at the docs of. The pages for a version are all
+// rendered at once, the first time they're asked for, and kept alongside a
+// copy of the version's hash so that a version that's deleted and published
+// again with different contents gets new docs.
+//
+//	$dir/$module/@v/$version/$package/index.html
+type docCache struct {
+	dir     string
+	flights flightGroup
+}
+
+func newDocCache(dir string) *docCache {
+	return &docCache{dir: dir}
+}
+
+// versionDir gives the directory that holds the docs for a module version
+func (d *docCache) versionDir(modpath, version string) (string, error) {
+	escPath, err := module.EscapePath(modpath)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(escPath), "@v", escVersion), nil
+}
+
+// page gives the rendered docs for a package in a module version, rendering
+// the docs for the whole version first if they aren't cached. The package is
+// a directory relative to the module root, or "" for the root.
+func (d *docCache) page(h handler, s store, modpath, version, pkg string) ([]byte, error) {
+	dir, err := d.versionDir(modpath, version)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := s.readSums(modpath, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.current(dir, sums.Hash) {
+		err := d.flights.do(modpath+"@"+version, func() error {
+			// another request may have rendered them since we last looked
+			if d.current(dir, sums.Hash) {
+				return nil
+			}
+			zipfile, err := s.file(modpath, version, ".zip")
+			if err != nil {
+				return err
+			}
+			log_info.Printf("rendering docs for %s@%s", modpath, version)
+			return h.renderDocs(dir, zipfile, modpath, version, sums.Hash)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(pkg), "index.html"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no package %s in %s@%s: %w", path.Join(modpath, pkg), modpath, version, apiError(http.StatusNotFound))
+	}
+	return b, err
+}
+
+// current checks whether the docs in a directory were rendered from a zip
+// with the given hash
+func (d *docCache) current(dir, hash string) bool {
+	b, err := os.ReadFile(filepath.Join(dir, ".hash"))
+	return err == nil && string(b) == hash
+}
+
+// renderDocs renders the docs for every package in a module zip into dir.
+// They're rendered into a temp directory first, so that dir only ever holds
+// a complete set.
+func (h handler) renderDocs(dir, zipfile, modpath, version, hash string) error {
+	pkgs, err := readPackages(zipfile, modpath, version)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".render-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dirs := make([]string, 0, len(pkgs))
+	for rel := range pkgs {
+		dirs = append(dirs, rel)
+	}
+	sort.Strings(dirs)
+	if _, ok := pkgs[""]; !ok {
+		dirs = append([]string{""}, dirs...)
+	}
+
+	for _, rel := range dirs {
+		data := docPageData{
+			Hostname: h.hostname,
+			Path:     modpath,
+			Version:  version,
+			Package:  pkgs[rel],
+		}
+		if rel == "" {
+			for _, sub := range dirs {
+				if sub != "" {
+					data.Packages = append(data.Packages, pkgs[sub])
+				}
+			}
+		}
+		var buf bytes.Buffer
+		if err := browsePages.ExecuteTemplate(&buf, "package", data); err != nil {
+			return fmt.Errorf("unable to render docs for %s: %w", path.Join(modpath, rel), err)
+		}
+		if err := writeFile(filepath.Join(tmp, filepath.FromSlash(rel), "index.html"), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmp, ".hash"), []byte(hash), 0644); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// readPackages parses the Go files in a module zip, giving the docs for each
+// package by its directory relative to the module root. Directories that the
+// go command ignores, and test files, are skipped.
+func readPackages(zipfile, modpath, version string) (map[string]*docPackage, error) {
+	zr, err := zip.OpenReader(zipfile)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	prefix := modpath + "@" + version + "/"
+	byDir := make(map[string][]*zip.File)
+	for _, f := range zr.File {
+		name := strings.TrimPrefix(f.Name, prefix)
+		if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") || ignoredPath(name) {
+			continue
+		}
+		byDir[path.Dir(name)] = append(byDir[path.Dir(name)], f)
+	}
+
+	pkgs := make(map[string]*docPackage)
+	for dir, files := range byDir {
+		rel := dir
+		if rel == "." {
+			rel = ""
+		}
+		p, err := parsePackage(files, path.Join(modpath, rel))
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			p.Dir = rel
+			pkgs[rel] = p
+		}
+	}
+	return pkgs, nil
+}
+
+// ignoredPath checks whether a file is somewhere the go command doesn't look
+// for packages
+func ignoredPath(name string) bool {
+	dir := path.Dir(name)
+	if dir == "." {
+		return false
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == "testdata" || elem == "vendor" || strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePackage parses the files of a single package. A directory can hold
+// files for more than one package, e.g. a generator with //go:build ignore,
+// in which case we document the package that most of the files are in.
+func parsePackage(files []*zip.File, importPath string) (*docPackage, error) {
+	fset := token.NewFileSet()
+	byName := make(map[string][]*ast.File)
+	for _, f := range files {
+		if f.UncompressedSize64 > maxDocSource {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		src, err := io.ReadAll(io.LimitReader(rc, maxDocSource))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		af, err := parser.ParseFile(fset, path.Base(f.Name), src, parser.ParseComments)
+		if err != nil {
+			// the go command would refuse to build it, but the rest of the
+			// package may still be worth reading
+			log_info.Printf("skipping %s in docs: %v", f.Name, err)
+			continue
+		}
+		byName[af.Name.Name] = append(byName[af.Name.Name], af)
+	}
+
+	var name string
+	for n, afs := range byName {
+		if len(afs) > len(byName[name]) || (len(afs) == len(byName[name]) && n < name) {
+			name = n
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	p, err := doc.NewFromFiles(fset, byName[name], importPath)
+	if err != nil {
+		return nil, err
+	}
+	return newDocPackage(fset, p), nil
+}
+
+// docPackage is what the docs show about a package
+type docPackage struct {
+	Name       string
+	ImportPath string
+	Dir        string
+	Synopsis   string
+	Doc        template.HTML
+	Consts     []docValue
+	Vars       []docValue
+	Funcs      []docFunc
+	Types      []docType
+}
+
+type docValue struct {
+	Decl string
+	Doc  template.HTML
+}
+
+type docFunc struct {
+	ID   string // the anchor to link to it with
+	Name string
+	Decl string
+	Doc  template.HTML
+}
+
+type docType struct {
+	Name    string
+	Decl    string
+	Doc     template.HTML
+	Consts  []docValue
+	Vars    []docValue
+	Funcs   []docFunc
+	Methods []docFunc
+}
+
+func newDocPackage(fset *token.FileSet, p *doc.Package) *docPackage {
+	d := &docPackage{
+		Name:       p.Name,
+		ImportPath: p.ImportPath,
+		Synopsis:   doc.Synopsis(p.Doc),
+		Doc:        docHTML(p.Doc),
+		Consts:     docValues(fset, p.Consts),
+		Vars:       docValues(fset, p.Vars),
+		Funcs:      docFuncs(fset, "", p.Funcs),
+	}
+	for _, t := range p.Types {
+		d.Types = append(d.Types, docType{
+			Name:    t.Name,
+			Decl:    formatDecl(fset, t.Decl),
+			Doc:     docHTML(t.Doc),
+			Consts:  docValues(fset, t.Consts),
+			Vars:    docValues(fset, t.Vars),
+			Funcs:   docFuncs(fset, "", t.Funcs),
+			Methods: docFuncs(fset, t.Name+".", t.Methods),
+		})
+	}
+	return d
+}
+
+func docValues(fset *token.FileSet, values []*doc.Value) []docValue {
+	var out []docValue
+	for _, v := range values {
+		out = append(out, docValue{Decl: formatDecl(fset, v.Decl), Doc: docHTML(v.Doc)})
+	}
+	return out
+}
+
+func docFuncs(fset *token.FileSet, idPrefix string, funcs []*doc.Func) []docFunc {
+	var out []docFunc
+	for _, f := range funcs {
+		// only the signature, not the body
+		decl := *f.Decl
+		decl.Body = nil
+		decl.Doc = nil
+		out = append(out, docFunc{ID: idPrefix + f.Name, Name: f.Name, Decl: formatDecl(fset, &decl), Doc: docHTML(f.Doc)})
+	}
+	return out
+}
+
+// formatDecl prints a declaration the way gofmt would
+func formatDecl(fset *token.FileSet, decl ast.Decl) string {
+	var buf bytes.Buffer
+	cfg := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if err := cfg.Fprint(&buf, fset, decl); err != nil {
+		return fmt.Sprintf("unable to print declaration: %v", err)
+	}
+	return buf.String()
+}
+
+// docHTML renders a doc comment as HTML. doc.ToHTML escapes the text
+// itself, so the result is safe to put in a page as it is.
+func docHTML(text string) template.HTML {
+	var buf bytes.Buffer
+	doc.ToHTML(&buf, text, nil)
+	return template.HTML(buf.String())
+}
+
+// docPage serves /doc/$module@$version/$package
+func (h handler) docPage(modpath, version, pkg string, w http.ResponseWriter, r *http.Request) {
+	if h.docs == nil {
+		writeError(w, apiError(http.StatusNotFound))
+		return
+	}
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s := h.modules()
+	zipfile, err := s.file(modpath, version, ".zip")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if missing(zipfile) {
+		writeError(w, fmt.Errorf("no version %s of %s: %w", version, modpath, apiError(http.StatusNotFound)))
+		return
+	}
+
+	b, err := h.docs.page(h, s, modpath, version, pkg)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	h.setCacheControl(w, modpath, false)
+	serveBytes(w, r, time.Time{}, b)
+}
+
+// docLatest redirects /doc/$module to the docs for its latest version
+func (h handler) docLatest(modpath string, w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+	s := h.modules()
+	versions, err := s.listed(modpath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	retracted, err := s.retractions(modpath, versions)
+	if err != nil {
+		log_error.Printf("unable to read retractions for %s: %v", modpath, err)
+	}
+	latest := latestVersion(retracted.filter(versions))
+	if latest == "" {
+		latest = latestVersion(versions)
+	}
+
+	escPath, _ := module.EscapePath(modpath)
+	escVersion, _ := module.EscapeVersion(latest)
+	http.Redirect(w, r, "/doc/"+escPath+"@"+escVersion+"/", http.StatusFound)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDocs(t *testing.T) {
+	h := uploadHandler(t)
+	h.docs = newDocCache(filepath.Join(h.root, "docs"))
+	body := moduleZipFiles(t, "orel.li/docs", "v1.0.0", map[string]string{
+		"go.mod": "module orel.li/docs\n",
+		"docs.go": `// Package docs says hello.
+package docs
+
+// Hello greets somebody.
+func Hello(name string) string { return "hello " + name }
+`,
+		"gen.go": "//go:build ignore\n\npackage main\n",
+		"sub/sub.go": `// Package sub has a type.
+package sub
+
+// Thing is a thing.
+type Thing struct{ N int }
+
+// Count counts things.
+func (t Thing) Count() int { return t.N }
+`,
+		"sub/sub_test.go":       "package sub\n\nfunc TestSecret() {}\n",
+		"testdata/skip/skip.go": "package skip\n",
+	})
+	if w := upload(h, "orel.li/docs", "v1.0.0", body); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		path   string
+		code   int
+		want   []string
+		unwant []string
+	}{
+		{"/doc/orel.li/docs@v1.0.0/", http.StatusOK, []string{
+			"package docs",
+			"says hello.",
+			"func Hello(name string) string",
+			`<a href="/doc/orel.li/docs@v1.0.0/sub">sub</a>`,
+			"Package sub has a type.",
+		}, []string{"package main", "skip"}},
+		{"/doc/orel.li/docs@v1.0.0/sub", http.StatusOK, []string{
+			"type Thing",
+			"Thing is a thing.",
+			`id="Thing.Count"`,
+			"func (t Thing) Count() int",
+		}, []string{"TestSecret", "return t.N"}},
+		{"/doc/orel.li/docs@v1.0.0/testdata/skip", http.StatusNotFound, nil, nil},
+		{"/doc/orel.li/docs@v1.0.0/nope", http.StatusNotFound, nil, nil},
+		{"/doc/orel.li/docs@v1.2.0/", http.StatusNotFound, nil, nil},
+	}
+	for _, test := range tests {
+		w := get(h, test.path)
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d: %s", test.path, test.code, w.Code, w.Body)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: expected page to contain %q", test.path, want)
+			}
+		}
+		for _, unwant := range test.unwant {
+			if strings.Contains(w.Body.String(), unwant) {
+				t.Errorf("%s: expected page not to contain %q", test.path, unwant)
+			}
+		}
+	}
+
+	// once rendered, the pages come from the cache
+	dir, err := h.docs.versionDir("orel.li/docs", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(h, "/doc/orel.li/docs@v1.0.0/"); w.Body.String() != "cached" {
+		t.Errorf("expected the cached page, got %q", w.Body)
+	}
+
+	w := get(h, "/doc/orel.li/docs")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/doc/orel.li/docs@v1.0.0/" {
+		t.Errorf("expected a redirect to the latest version, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+)
+
+// flightGroup deduplicates concurrent calls that do the same work. It's the
+// same idea as golang.org/x/sync/singleflight, minus the parts we don't need.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call in progress
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do calls f, unless a call for the same key is already in progress, in which
+// case it waits for that call to finish and returns its result instead
+func (g *flightGroup) do(key string, f func() error) error {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if fl, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-fl.done
+		return fl.err
+	}
+	fl := &flight{done: make(chan struct{})}
+	g.flights[key] = fl
+	g.mu.Unlock()
+
+	fl.err = f()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(fl.done)
+	return fl.err
+}
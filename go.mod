@@ -2,10 +2,14 @@ module orel.li/mir
 
 go 1.18
 
-require golang.org/x/mod v0.5.1
+require (
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/mod v0.5.1
+	golang.org/x/net v0.0.0-20211216030914-fe4d6282115f
+	golang.org/x/term v0.0.0-20210503060354-a79de5458b56
+)
 
 require (
-	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3 // indirect
-	golang.org/x/net v0.0.0-20211216030914-fe4d6282115f // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/xerrors v0.0.0-20191011141410-1b5146add898 // indirect
 )
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"html/template"
+)
+
+type goGetData struct {
+	ImportPath string // the import path that was requested
+	ModPath    string // the module that contains ImportPath
+	DLRoot     string // base url of our module proxy
+	Browse     string // url of the browse page for ModPath
+}
+
+var goGetPage = template.Must(template.New("go-get").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="{{.ModPath}} mod {{.DLRoot}}">
+<meta name="go-source" content="{{.ModPath}} {{.Browse}} {{.Browse}} {{.Browse}}">
+</head>
+<body>
+go get {{.ImportPath}}
+</body>
+</html>
+`))
@@ -1,25 +1,22 @@
 package main
 
 import (
-	"archive/zip"
+	"bytes"
 	"context"
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
-	"orel.li/mir/internal/semver"
+	"golang.org/x/mod/module"
 )
 
 // this is pretty janky, but I didn't want to import a routing library
@@ -29,7 +26,17 @@ var (
 	infoP   = regexp.MustCompile(`^/dl/(.+)/@v/(.+)\.info$`)
 	modP    = regexp.MustCompile(`^/dl/(.+)/@v/(.+)\.mod$`)
 	zipP    = regexp.MustCompile(`^/dl/(.+)/@v/(.+)\.zip$`)
+	gosumP  = regexp.MustCompile(`^/dl/(.+)/@v/(.+)\.gosum$`)
+	sumsP   = regexp.MustCompile(`^/api/(.+)/@v/(.+)\.sums$`)
 	uploadP = regexp.MustCompile(`^/ul/(.+)/@v/(.+)\.zip$`)
+	adminP  = regexp.MustCompile(`^/admin/(.+)/@v/([^/]+)/(yank|delete|restore)$`)
+
+	browseIndexP   = regexp.MustCompile(`^/dl/?$`)
+	browseModuleP  = regexp.MustCompile(`^/dl/([^@]+)/$`)
+	browseVersionP = regexp.MustCompile(`^/dl/(.+)/@v/([^/]+)/$`)
+
+	docP       = regexp.MustCompile(`^/doc/([^@]+)@([^/]+)(/.*)?$`)
+	docLatestP = regexp.MustCompile(`^/doc/([^@]+?)/?$`)
 )
 
 type handler struct {
@@ -37,9 +44,54 @@ type handler struct {
 	socketPath string
 	root       string
 	hostname   string
-	auth       map[string]string
+
+	// tlsCert and tlsKey are files for serving https, if we do
+	tlsCert string
+	tlsKey  string
+
+	// auth holds the users given with the deprecated -auth-users flag
+	auth map[string]string
+
+	// users is the users file, if there is one
+	users *userFile
+
+	// upstream is where we fetch modules that we don't host, if anywhere
+	upstream *upstream
+
+	// sumdb is our checksum database, if we're running one
+	sumdb *checksumDB
+
+	// acl limits where each user may publish and what they may download.
+	// Without one, every user may publish everywhere.
+	acl *accessList
+
+	// tokens are the API tokens that may be used instead of passwords
+	tokens *tokenFile
+
+	// accessLog is where we log every request
+	accessLog *accessLog
+
+	// metrics serves /metrics, if we serve it on the same listener as
+	// everything else
+	metrics http.Handler
+
+	// health is the state of our readiness checks
+	health *health
+
+	// limits are how much we let each client do
+	limits *limits
+
+	// proxies are the reverse proxies we believe about who the client is
+	proxies *trustedProxies
+
+	// docs is where we keep the rendered docs for module versions
+	docs *docCache
 }
 
+// shutdownTimeout is how long we wait for requests in flight to finish when
+// shutting down
+const shutdownTimeout = 30 * time.Second
+
 func (h handler) run() error {
 	if h.hostname == "" {
 		return fmt.Errorf("hostname missing but hostname is required")
@@ -51,17 +103,30 @@ func (h handler) run() error {
 	}
 
 	server := http.Server{
-		Handler: h,
+		Handler: h.proxies.wrap(h.accessLog.wrap(h.instrument(h))),
 	}
+	stopped := make(chan struct{})
 	onShutdown(func() error {
+		defer close(stopped)
+		h.health.drain()
 		log_info.Print("shutting down http server")
-		return server.Shutdown(context.TODO())
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return server.Shutdown(ctx)
 	})
 
 	// ??
 	start := time.Now()
-	err = server.Serve(l)
-	if err != nil {
+	if h.tlsCert != "" {
+		err = server.ServeTLS(l, h.tlsCert, h.tlsKey)
+	} else {
+		err = server.Serve(l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		// Serve returns as soon as Shutdown starts, but Shutdown is still
+		// waiting on the requests in flight
+		<-stopped
+	} else if err != nil {
 		// I dunno how to check for the right error, offhand
 		if time.Since(start) < time.Second {
 			return fmt.Errorf("unable to start server: %v", err)
@@ -99,237 +164,626 @@ func (h handler) listen() (net.Listener, error) {
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log_info.Printf("%s %s %s %s", r.Method, r.Host, r.URL.Host, r.URL.String())
+	// $import/path?go-get=1 - the go command asking where a module lives
+	if r.URL.Query().Get("go-get") == "1" {
+		h.goGet(w, r)
+		return
+	}
 
 	// this is very stupid but I didn't want to add a routing library
 	// dependency for five endpoints, since part of my goal is to not depend on
 	// anything with github.com in the import path.
 
+	// /healthz and /readyz - for whatever is keeping us running
+	switch r.URL.Path {
+	case "/healthz":
+		h.healthz(w, r)
+		return
+	case "/readyz":
+		h.readyz(w, r)
+		return
+	}
+
+	// /metrics - prometheus metrics
+	if r.URL.Path == "/metrics" && h.metrics != nil {
+		h.metrics.ServeHTTP(w, r)
+		return
+	}
+
+	// /sumdb/$name/... - the checksum database protocol
+	if h.sumdb != nil && h.sumdb.serves(r.URL.Path) {
+		if modpath, ok := h.sumdb.lookupPath(r.URL.Path); ok {
+			if err := h.authorizeRead(r, modpath); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		h.sumdb.ServeHTTP(w, r)
+		return
+	}
+
 	// $base/$module/@v/list - list versions for a module
 	if matches := listP.FindStringSubmatch(r.URL.Path); matches != nil {
-		modpath := matches[1]
+		modpath, err := unescapePath(matches[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		h.list(modpath, w, r)
 		return
 	}
 
 	// $base/$module/@latest - get latest version number with timestamp
 	if matches := latestP.FindStringSubmatch(r.URL.Path); matches != nil {
-		modpath := matches[1]
+		modpath, err := unescapePath(matches[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		h.latest(modpath, w, r)
 		return
 	}
 
 	// $base/$module/@v/$version.info - get info about a specific version
 	if matches := infoP.FindStringSubmatch(r.URL.Path); matches != nil {
-		modpath := matches[1]
-		modversion := matches[2]
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			// the go command also asks for the info of queries like a
+			// branch or a commit, which only upstream can resolve
+			if modpath, query, ok := h.upstreamQuery(matches[1], matches[2]); ok {
+				h.queryInfo(modpath, query, w, r)
+				return
+			}
+			writeError(w, err)
+			return
+		}
 		h.info(modpath, modversion, w, r)
 		return
 	}
 
 	// $base/$module/@v/$version.mod - get go.mod file for a specific version
 	if matches := modP.FindStringSubmatch(r.URL.Path); matches != nil {
-		modpath := matches[1]
-		modversion := matches[2]
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		h.modfile(modpath, modversion, w, r)
 		return
 	}
 
 	// $base/$module/@v/$version.zip - get the zip bundle of a package version
 	if matches := zipP.FindStringSubmatch(r.URL.Path); matches != nil {
-		modpath := matches[1]
-		modversion := matches[2]
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		h.zipfile(modpath, modversion, w, r)
 		return
 	}
 
+	// $base/$module/@v/$version.gosum - get the go.sum lines for a version
+	if matches := gosumP.FindStringSubmatch(r.URL.Path); matches != nil {
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h.gosumfile(modpath, modversion, w, r)
+		return
+	}
+
+	// /api/$module/@v/$version.sums - get the go.sum hashes for a version as json
+	if matches := sumsP.FindStringSubmatch(r.URL.Path); matches != nil {
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h.sums(modpath, modversion, w, r)
+		return
+	}
+
 	if matches := uploadP.FindStringSubmatch(r.URL.Path); matches != nil {
-		modpath := matches[1]
-		modversion := matches[2]
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		h.upload(modpath, modversion, w, r)
 		return
 	}
 
+	// /admin/$module/@v/$version/$action - change a published version
+	if matches := adminP.FindStringSubmatch(r.URL.Path); matches != nil {
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h.admin(modpath, modversion, matches[3], w, r)
+		return
+	}
+
+	// /index?since=$timestamp - the versions published since a time
+	if r.URL.Path == "/index" {
+		h.index(w, r)
+		return
+	}
+
+	// /dl/ - the list of modules we host, for people with browsers
+	if browseIndexP.MatchString(r.URL.Path) {
+		h.browseIndex(w, r)
+		return
+	}
+
+	// /dl/$module/ - the versions of a module
+	if matches := browseModuleP.FindStringSubmatch(r.URL.Path); matches != nil {
+		modpath, err := unescapePath(matches[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h.browseModule(modpath, w, r)
+		return
+	}
+
+	// /dl/$module/@v/$version/ - the files in a version of a module
+	if matches := browseVersionP.FindStringSubmatch(r.URL.Path); matches != nil {
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h.browseVersionPage(modpath, modversion, w, r)
+		return
+	}
+
+	// /doc/$module@$version/$package - rendered package docs
+	if matches := docP.FindStringSubmatch(r.URL.Path); matches != nil {
+		modpath, modversion, err := unescapeModule(matches[1], matches[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		pkg := strings.TrimPrefix(path.Clean("/"+matches[3]), "/")
+		h.docPage(modpath, modversion, pkg, w, r)
+		return
+	}
+
+	// /doc/$module - the docs for the latest version of a module
+	if matches := docLatestP.FindStringSubmatch(r.URL.Path); matches != nil {
+		modpath, err := unescapePath(matches[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h.docLatest(modpath, w, r)
+		return
+	}
+
 	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte("not found"))
 	return
 }
 
-// locate searches our module root for a given modpath
-func (h handler) locate(modpath string) ([]os.DirEntry, error) {
-	localDir := filepath.Join(h.root, "modules", modpath)
-	return os.ReadDir(localDir)
+// unescapePath decodes a case-encoded module path as sent by the go command
+// (where uppercase letters are written as ! followed by the lowercase letter)
+// and checks that the result is a valid module path.
+func unescapePath(escaped string) (string, error) {
+	modpath, err := module.UnescapePath(escaped)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	if err := module.CheckPath(modpath); err != nil {
+		return "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	return modpath, nil
+}
+
+// unescapeModule decodes a case-encoded module path and version, checking
+// that the version is valid for the module path.
+func unescapeModule(escPath, escVersion string) (string, string, error) {
+	modversion, err := module.UnescapeVersion(escVersion)
+	if err != nil {
+		return "", "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	modpath, err := module.UnescapePath(escPath)
+	if err != nil {
+		return "", "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	if err := module.Check(modpath, modversion); err != nil {
+		return "", "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	return modpath, modversion, nil
+}
+
+// goGet serves the html page that the go command fetches when resolving an
+// import path. The page points the go command at our module proxy, using the
+// module root that actually exists on disk for the requested path.
+func (h handler) goGet(w http.ResponseWriter, r *http.Request) {
+	importPath := path.Join(h.hostname, r.URL.Path)
+	modpath, err := h.findModule(importPath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	escaped, err := module.EscapePath(modpath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the browse pages are per version and don't show single files, so
+	// every go-source link goes to the page for the module
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = goGetPage.Execute(w, goGetData{
+		ImportPath: importPath,
+		ModPath:    modpath,
+		DLRoot:     fmt.Sprintf("https://%s/dl", h.hostname),
+		Browse:     fmt.Sprintf("https://%s/dl/%s/", h.hostname, escaped),
+	})
+	if err != nil {
+		log_error.Printf("error writing go-get page for %s: %v", importPath, err)
+	}
+}
+
+// findModule finds the module that contains a given import path by checking
+// each of its prefixes, longest first, for a module stored in our root
+func (h handler) findModule(importPath string) (string, error) {
+	for p := importPath; p != "." && p != "/"; p = path.Dir(p) {
+		ok, err := h.modules().has(p)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return p, nil
+		}
+		if !strings.Contains(p, "/") {
+			break
+		}
+	}
+	return "", apiError(http.StatusNotFound)
+}
+
+// modules is the store of modules that have been uploaded to us
+func (h handler) modules() store {
+	return store{dir: filepath.Join(h.root, "modules")}
 }
 
 // writeError writes a given error to an underlying http responsewriter
 func writeError(w http.ResponseWriter, err error) {
+	id := requestPrefix(w)
+
 	// this sucks and is wrong
 	if os.IsNotExist(err) {
-		log_info.Printf("404 %v", err)
+		log_info.Printf("%s404 %v", id, err)
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "not found")
 		return
 	}
 
+	var badZip invalidZipError
+	if errors.As(err, &badZip) {
+		log_info.Printf("%s%d %v", id, http.StatusUnprocessableEntity, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(badZip)
+		return
+	}
+
+	var tooMany tooManyRequests
+	if errors.As(err, &tooMany) {
+		w.Header().Set("Retry-After", tooMany.retryAfterHeader())
+	}
+
 	var status apiError
 	if errors.As(err, &status) {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mir"`)
+		}
 		w.WriteHeader(int(status))
-		log_error.Printf("%d %v", status, err)
+		log_error.Printf("%s%d %v", id, status, err)
 		fmt.Fprintf(w, err.Error())
 		return
 	}
 
 	w.WriteHeader(http.StatusInternalServerError)
 	fmt.Fprintf(w, "internal server error: %v", err)
-	log_error.Printf("500 %v", err)
+	log_error.Printf("%s500 %v", id, err)
 	return
 }
 
-// getVersions gets the list of versions available for a module
-func (h handler) getVersions(modpath string) ([]string, error) {
-	dirpath, _ := filepath.Split(modpath)
-	localDir := filepath.Join(h.root, "modules", dirpath)
-	files, err := os.ReadDir(localDir)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return nil, apiError(http.StatusNotFound)
-		}
-		if errors.Is(err, fs.ErrPermission) {
-			return nil, apiError(http.StatusForbidden)
-		}
-		return nil, joinErrors(err, apiError(http.StatusInternalServerError))
+// latest serves the @latest endpoint
+func (h handler) latest(modpath string, w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	allVersions := make([]string, 0, len(files))
-	for _, f := range files {
-		name := f.Name()
-		if filepath.Ext(name) != ".zip" {
-			continue
-		}
-		parts := strings.Split(name[:len(name)-4], "@")
-		if len(parts) != 2 {
-			continue
-		}
-		if !semver.IsValid(parts[1]) {
-			continue
+	proxied, err := h.proxied(modpath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if proxied {
+		info, err := h.upstream.latest(modpath)
+		if err != nil {
+			writeError(w, err)
+			return
 		}
-		allVersions = append(allVersions, parts[1])
+		h.setCacheControl(w, modpath, false)
+		serveJSON(w, r, time.Time{}, info)
+		return
 	}
 
-	if len(allVersions) == 0 {
-		return nil, apiError(http.StatusNotFound)
+	versions, err := h.modules().listed(modpath)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
-	semver.Sort(allVersions)
-	return allVersions, nil
-}
-
-func (h handler) stat(modpath, version string) (os.FileInfo, error) {
-	log_info.Printf("stat modpath: %s version: %s", modpath, version)
-	dirname, basename := filepath.Split(modpath)
-	absdir := filepath.Join(h.root, "modules", dirname)
-	fname := filepath.Join(absdir, fmt.Sprintf("%s@%s.zip", basename, version))
-	return os.Stat(fname)
-}
+	log_info.Printf("all versions: %v", versions)
 
-// latest serves the @latest endpoint
-func (h handler) latest(modpath string, w http.ResponseWriter, r *http.Request) {
-	versions, err := h.getVersions(modpath)
+	retracted, err := h.modules().retractions(modpath, versions)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	log_info.Printf("all versions: %v", versions)
 
-	last := versions[len(versions)-1]
+	// when every version has been retracted, the latest one is still the
+	// best we can offer
+	if allowed := retracted.filter(versions); len(allowed) > 0 {
+		versions = allowed
+	}
+	last := latestVersion(versions)
 
-	fi, err := h.stat(modpath, last)
+	info, err := h.modules().readInfo(modpath, last)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	json.NewEncoder(w).Encode(moduleInfo{
-		Version: last,
-		Time:    fi.ModTime(),
-	})
+	info.Retracted = retracted.rationale(last)
+	h.setCacheControl(w, modpath, false)
+	serveJSON(w, r, time.Time{}, info)
 }
 
 // list serves the $base/$module/@v/list endpoint
 func (h handler) list(modpath string, w http.ResponseWriter, r *http.Request) {
-	versions, err := h.getVersions(modpath)
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	proxied, err := h.proxied(modpath)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
+	var versions []string
+	if proxied {
+		versions, err = h.upstream.list(modpath)
+	} else {
+		versions, err = h.modules().listed(modpath)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var buf bytes.Buffer
 	for _, version := range versions {
-		fmt.Fprintln(w, version)
+		fmt.Fprintln(&buf, version)
 	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	h.setCacheControl(w, modpath, false)
+	serveBytes(w, r, time.Time{}, buf.Bytes())
 }
 
 // info serves the $base/$module/@v/$version.info endpoint
 func (h handler) info(modpath, modversion string, w http.ResponseWriter, r *http.Request) {
-	fi, err := h.stat(modpath, modversion)
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s, proxied, err := h.storeFor(modpath, modversion, ".info")
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	json.NewEncoder(w).Encode(moduleInfo{
-		Version: modversion,
-		Time:    fi.ModTime(),
-	})
+
+	info, err := s.readInfo(modpath, modversion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// retractions are informational here, so don't fail the request over
+	// them. They come from the same latest version as @latest, which leaves
+	// out yanked versions. Proxied modules have their own retractions in
+	// their own info.
+	if !proxied {
+		versions, err := s.listed(modpath)
+		if err == nil {
+			var retracted retractions
+			retracted, err = s.retractions(modpath, versions)
+			info.Retracted = retracted.rationale(modversion)
+		}
+		if err != nil {
+			log_error.Printf("unable to read retractions for %s: %v", modpath, err)
+		}
+	}
+
+	// the retractions in an info can change when a later version is
+	// published, so it isn't immutable the way the zip and go.mod are
+	h.setCacheControl(w, modpath, proxied)
+	serveJSON(w, r, info.Time, info)
 }
 
-func (h handler) zipPath(modpath, version string) string {
-	dirname, basename := filepath.Split(modpath)
-	absdir := filepath.Join(h.root, "modules", dirname)
-	return filepath.Join(absdir, fmt.Sprintf("%s@%s.zip", basename, version))
+// proxied checks whether requests for a module should go to our upstream
+// proxies. We never proxy modules that we host ourselves.
+func (h handler) proxied(modpath string) (bool, error) {
+	if h.upstream == nil {
+		return false, nil
+	}
+	hosted, err := h.modules().has(modpath)
+	if err != nil {
+		return false, err
+	}
+	return !hosted, nil
 }
 
-func (h handler) uploadPath(modpath, version string) string {
-	hash := md5.Sum([]byte(fmt.Sprintf("%s@%s", modpath, version)))
-	fname := fmt.Sprintf("%x.zip", hash)
-	return filepath.Join(h.root, "uploads", fname)
+// upstreamQuery decodes a case-encoded module path and a version query that
+// isn't a canonical version, such as master or v1.2, for a module that we
+// proxy. Modules that we host only ever have canonical versions.
+func (h handler) upstreamQuery(escPath, escQuery string) (string, string, bool) {
+	if h.upstream == nil || strings.Contains(escQuery, "/") {
+		return "", "", false
+	}
+	modpath, err := unescapePath(escPath)
+	if err != nil {
+		return "", "", false
+	}
+	query, err := module.UnescapeVersion(escQuery)
+	if err != nil {
+		return "", "", false
+	}
+	if proxied, err := h.proxied(modpath); err != nil || !proxied {
+		return "", "", false
+	}
+	return modpath, query, true
 }
 
-func (h handler) openZip(modpath, version string) (io.ReadCloser, error) {
-	return os.Open(h.zipPath(modpath, version))
+// queryInfo serves the $base/$module/@v/$query.info endpoint for a version
+// query that upstream resolves
+func (h handler) queryInfo(modpath, query string, w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	info, err := h.upstream.query(modpath, query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// a query can resolve to something else tomorrow, e.g. when a branch
+	// moves, so it's never immutable
+	h.setCacheControl(w, modpath, false)
+	serveJSON(w, r, time.Time{}, info)
+}
+
+// storeFor gives the store that holds a given file of a module version, by
+// its extension. Versions of modules that we don't host are fetched from
+// upstream into our cache first: just the .info or .mod if that's all that's
+// needed, since the go command asks for those of many versions whose zips
+// it never downloads.
+func (h handler) storeFor(modpath, version, ext string) (store, bool, error) {
+	proxied, err := h.proxied(modpath)
+	if err != nil {
+		return store{}, false, err
+	}
+	if !proxied {
+		return h.modules(), false, nil
+	}
+	if ext == ".zip" {
+		err = h.upstream.fetch(modpath, version)
+	} else {
+		err = h.upstream.fetchFile(modpath, version, ext)
+	}
+	if err != nil {
+		return store{}, true, err
+	}
+	return h.upstream.cache, true, nil
+}
+
+// zipPath gives the path of the zip file for a module version
+func (h handler) zipPath(modpath, version string) (string, error) {
+	return h.modules().file(modpath, version, ".zip")
 }
 
 // modfile serves the $base/$module/@v/$version.mod endpoint
 func (h handler) modfile(modpath, modversion string, w http.ResponseWriter, r *http.Request) {
-	rc, err := zip.OpenReader(h.zipPath(modpath, modversion))
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s, _, err := h.storeFor(modpath, modversion, ".mod")
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	defer rc.Close()
 
-	mfname := fmt.Sprintf("%s@%s/go.mod", modpath, modversion)
-	f, err := rc.Open(mfname)
+	b, err := s.readMod(modpath, modversion)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	defer f.Close()
 
-	if _, err := io.Copy(w, f); err != nil {
-		log_error.Printf("error copying modfile contents for %s version %s: %v", modpath, modversion, err)
+	if hash, err := hashGoMod(b); err == nil {
+		w.Header().Set("ETag", etag(hash))
 	}
+	// the info isn't worth fetching from upstream just for this
+	var modtime time.Time
+	if fname, err := s.file(modpath, modversion, ".info"); err == nil && !missing(fname) {
+		if info, err := s.readInfo(modpath, modversion); err == nil {
+			modtime = info.Time
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	h.setCacheControl(w, modpath, true)
+	serveBytes(w, r, modtime, b)
 }
 
 // zipfile serves the $base/$module/@v/$version.zip endpoint
 func (h handler) zipfile(modpath, modversion string, w http.ResponseWriter, r *http.Request) {
-	zf, err := h.openZip(modpath, modversion)
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s, _, err := h.storeFor(modpath, modversion, ".zip")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	fname, err := s.file(modpath, modversion, ".zip")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	zf, err := os.Open(fname)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 	defer zf.Close()
 
-	w.Header().Add("Content-Type", "application/zip")
-	if _, err := io.Copy(w, zf); err != nil {
-		log_error.Printf("error writing zip for module %s version %s: %v", modpath, modversion, err)
+	// the h1 hash is of the zip's contents rather than its bytes, but the
+	// bytes of a published zip never change, so it's as good as strong
+	if sums, err := s.readSums(modpath, modversion); err == nil {
+		w.Header().Set("ETag", etag(sums.Hash))
+	} else {
+		log_error.Printf("unable to read sums for %s@%s: %v", modpath, modversion, err)
 	}
+	var modtime time.Time
+	if info, err := s.readInfo(modpath, modversion); err == nil {
+		modtime = info.Time
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	h.setCacheControl(w, modpath, true)
+	http.ServeContent(w, r, "", modtime, zf)
 }
 
 func (h handler) upload(modpath, modversion string, w http.ResponseWriter, r *http.Request) {
@@ -338,75 +792,145 @@ func (h handler) upload(modpath, modversion string, w http.ResponseWriter, r *ht
 		return
 	}
 
-	user, pass, ok := r.BasicAuth()
-	if !ok {
-		writeError(w, apiError(http.StatusUnauthorized))
+	user, err := h.authenticate(r, scopePublish, modpath)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+	log_info.Printf("upload of %s@%s by %s", modpath, modversion, user)
 
-	hash := h.auth[user]
-	if hash == "" {
-		writeError(w, apiError(http.StatusUnauthorized))
+	done, err := h.limits.startUpload(remoteHost(r), user)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+	defer done()
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)); err != nil {
-		writeError(w, fmt.Errorf("%v: %w", err, apiError(http.StatusUnauthorized)))
+	if err := h.acl.checkPublish(user, modpath); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	dest := h.zipPath(modpath, modversion)
+	publishTime := time.Now().UTC()
+	if t := r.URL.Query().Get("time"); t != "" {
+		publishTime, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			writeError(w, fmt.Errorf("bad time parameter: %v: %w", err, apiError(http.StatusBadRequest)))
+			return
+		}
+		publishTime = publishTime.UTC()
+	}
+
+	// holding the claim means that nobody else can be uploading the same
+	// version, so nothing can appear at dest between checking it and moving
+	// the upload there
+	release, err := h.claimVersion(modpath, modversion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+
+	dest, err := h.zipPath(modpath, modversion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 	if _, err := os.Stat(dest); !errors.Is(err, fs.ErrNotExist) {
 		writeError(w, apiError(http.StatusConflict))
 		return
 	}
 
-	p, err := h.doUpload(modpath, modversion, r)
+	// a version that was deleted can only be restored: anybody who got it
+	// before has its hashes in their go.sum, so it can never change
+	trashed, err := h.trash().file(modpath, modversion, ".zip")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !missing(trashed) {
+		writeError(w, fmt.Errorf("%s@%s was deleted, and can only be restored: %w", modpath, modversion, apiError(http.StatusConflict)))
+		return
+	}
+
+	p, size, err := h.receiveUpload(w, r)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	defer os.Remove(p)
 
 	if err := h.verifyUpload(modpath, modversion, p); err != nil {
+		var badZip invalidZipError
+		if errors.As(err, &badZip) {
+			uploadRejections.inc()
+		}
 		writeError(w, err)
 		return
 	}
 
+	// the .mod, .info, and .sums files go in first, so that they're there by
+	// the time anybody can see the zip. If the zip never makes it, they're
+	// taken back out.
+	published := false
+	defer func() {
+		if !published {
+			for _, ext := range []string{".mod", ".info", ".sums"} {
+				if fname, err := h.modules().file(modpath, modversion, ext); err == nil {
+					os.Remove(fname)
+				}
+			}
+		}
+	}()
+	gomod, err := zipGoMod(p, modpath, modversion)
+	if err != nil {
+		writeError(w, fmt.Errorf("unable to read go.mod from upload: %w", err))
+		return
+	}
+	if err := h.modules().writeMod(modpath, modversion, gomod); err != nil {
+		writeError(w, fmt.Errorf("unable to write mod file: %w", err))
+		return
+	}
+	if err := h.modules().writeInfo(modpath, moduleInfo{Version: modversion, Time: publishTime}); err != nil {
+		writeError(w, fmt.Errorf("unable to write info file: %w", err))
+		return
+	}
+	sums, err := hashVersion(modpath, modversion, p, gomod)
+	if err != nil {
+		writeError(w, fmt.Errorf("unable to hash upload: %w", err))
+		return
+	}
+	if err := h.modules().writeSums(*sums); err != nil {
+		writeError(w, fmt.Errorf("unable to write sums file: %w", err))
+		return
+	}
+
 	if err := os.Rename(p, dest); err != nil {
 		writeError(w, fmt.Errorf("unable to move upload into place: %w", err))
 		return
 	}
-	w.Write([]byte("ok"))
-}
-
-func (h handler) doUpload(modpath, modversion string, r *http.Request) (string, error) {
-	p := h.uploadPath(modpath, modversion)
-	log_info.Printf("uploading to %v", p)
-	f, err := os.Create(p)
-	if err != nil {
-		return "", fmt.Errorf("unable to open destination path: %w", err)
+	published = true
+	uploads.inc()
+	uploadSize.observe(float64(size))
+	if err := h.recordPublish(modpath, modversion); err != nil {
+		log_error.Printf("unable to add %s@%s to the publish log: %v", modpath, modversion, err)
 	}
-	defer f.Close()
 
-	log_info.Printf("copying body data to %v", p)
-	if _, err := io.Copy(f, r.Body); err != nil {
-		return "", fmt.Errorf("failed to write upload file locally: %w", err)
+	// the version is published by now, and anything that doesn't make it
+	// into the checksum database here gets added on its first lookup. The
+	// database is public, so modules that need a login stay out of it.
+	if h.sumdb != nil && h.acl.public(modpath) {
+		if err := h.sumdb.record(modpath, modversion); err != nil {
+			log_error.Printf("unable to add %s@%s to checksum database: %v", modpath, modversion, err)
+		}
 	}
-	return p, nil
+	w.Write([]byte("ok"))
 }
 
 func (h handler) verifyUpload(modpath, modversion, fpath string) error {
 	log_info.Printf("verifying upload data")
-	rc, err := zip.OpenReader(fpath)
-	if err != nil {
-		return fmt.Errorf("unable to verify upload: %w", err)
-	}
-
-	prefix := fmt.Sprintf("%s@%s/", modpath, modversion)
-	for _, f := range rc.File {
-		if !strings.HasPrefix(f.Name, prefix) {
-			return fmt.Errorf("zip contains file with bad name: %w", err)
-		}
+	if err := checkModuleZip(modpath, modversion, fpath); err != nil {
+		return err
 	}
 	log_info.Printf("upload data verified")
 	return nil
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHandler creates a handler whose module root is a fresh temp directory
+func testHandler(t *testing.T) handler {
+	return handler{
+		root:     t.TempDir(),
+		hostname: "orel.li",
+		auth:     make(authUsers),
+	}
+}
+
+// addVersion stores a module version directly in a handler's module store,
+// without going through an upload. The zip is empty, since nothing here reads
+// it.
+func addVersion(t *testing.T, h handler, modpath, version, gomod string) {
+	t.Helper()
+	modules := h.modules()
+	if gomod == "" {
+		gomod = fmt.Sprintf("module %s\n", modpath)
+	}
+	if err := modules.writeMod(modpath, version, []byte(gomod)); err != nil {
+		t.Fatal(err)
+	}
+	info := moduleInfo{Version: version, Time: time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)}
+	if err := modules.writeInfo(modpath, info); err != nil {
+		t.Fatal(err)
+	}
+	fname, err := modules.file(modpath, version, ".zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fname, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	var tests = []struct {
+		name     string
+		versions []string
+		gomod    string // go.mod of every version
+		latest   string
+	}{
+		{
+			name:     "release",
+			versions: []string{"v1.0.0", "v1.2.5", "v1.1.0"},
+			latest:   "v1.2.5",
+		},
+		{
+			name:     "release over prerelease",
+			versions: []string{"v1.2.5", "v1.3.0-rc.1"},
+			latest:   "v1.2.5",
+		},
+		{
+			name:     "prerelease when there's no release",
+			versions: []string{"v1.3.0-rc.1", "v1.3.0-rc.2", "v0.0.0-20220101000000-abcdefabcdef"},
+			latest:   "v1.3.0-rc.2",
+		},
+		{
+			name: "newest pseudo-version",
+			versions: []string{
+				"v0.0.0-20200101000000-abcdefabcdef",
+				"v1.2.4-0.20190101000000-abcdefabcdef",
+			},
+			latest: "v0.0.0-20200101000000-abcdefabcdef",
+		},
+		{
+			name:     "compatible over incompatible",
+			versions: []string{"v1.5.0", "v2.0.0+incompatible"},
+			latest:   "v1.5.0",
+		},
+		{
+			name:     "compatible prerelease over incompatible release",
+			versions: []string{"v1.5.0-pre", "v2.0.0+incompatible"},
+			latest:   "v1.5.0-pre",
+		},
+		{
+			name:     "incompatible when there's nothing compatible",
+			versions: []string{"v2.0.0+incompatible", "v3.0.0+incompatible"},
+			latest:   "v3.0.0+incompatible",
+		},
+		{
+			name:     "incompatible over compatible pseudo-version",
+			versions: []string{"v0.0.0-20220101000000-abcdefabcdef", "v2.0.0+incompatible"},
+			latest:   "v2.0.0+incompatible",
+		},
+		{
+			name:     "skip retracted",
+			versions: []string{"v1.0.0", "v1.1.0", "v1.2.0"},
+			gomod:    "module orel.li/x\n\nretract [v1.1.0, v1.2.0]\n",
+			latest:   "v1.0.0",
+		},
+		{
+			name:     "everything retracted",
+			versions: []string{"v1.0.0", "v1.1.0"},
+			gomod:    "module orel.li/x\n\nretract [v1.0.0, v1.1.0]\n",
+			latest:   "v1.1.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHandler(t)
+			for _, v := range tt.versions {
+				addVersion(t, h, "orel.li/x", v, tt.gomod)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/dl/orel.li/x/@latest", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, saw %d: %s", w.Code, w.Body)
+			}
+
+			var info moduleInfo
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatalf("bad @latest response: %v", err)
+			}
+			if info.Version != tt.latest {
+				t.Errorf("expected latest version %s, saw %s", tt.latest, info.Version)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	h := testHandler(t)
+	addVersion(t, h, "orel.li/x", "v1.0.0", "")
+	addVersion(t, h, "orel.li/x", "v1.1.0", "module orel.li/x\n\nretract v1.0.0\n")
+	addVersion(t, h, "orel.li/y", "v2.0.0+incompatible", "")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/dl/orel.li/x/@v/list", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, saw %d: %s", w.Code, w.Body)
+	}
+
+	// retracted versions stay listed, and sibling modules stay out
+	if got, want := w.Body.String(), "v1.0.0\nv1.1.0\n"; got != want {
+		t.Errorf("expected version list %q, saw %q", want, got)
+	}
+}
+
+func TestEscapedPaths(t *testing.T) {
+	h := uploadHandler(t)
+	if w := upload(h, "orel.li/!foo", "v1.0.0", moduleZip(t, "orel.li/Foo", "v1.0.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	// stored and served under the escaped path
+	if _, err := os.Stat(filepath.Join(h.root, "modules", "orel.li", "!foo", "@v", "v1.0.0.zip")); err != nil {
+		t.Errorf("expected the zip under its escaped path: %v", err)
+	}
+	if w := get(h, "/dl/orel.li/!foo/@v/list"); w.Code != http.StatusOK || w.Body.String() != "v1.0.0\n" {
+		t.Errorf("expected the version to be listed, got %d %q", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/orel.li/!foo/@v/v1.0.0.mod"); w.Code != http.StatusOK || w.Body.String() != "module orel.li/Foo\n" {
+		t.Errorf("expected the go.mod, got %d %q", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/orel.li/foo/@v/list"); w.Code != http.StatusNotFound {
+		t.Errorf("expected a path differing in case to be another module, got %d", w.Code)
+	}
+
+	for _, path := range []string{
+		"/dl/orel.li/Foo/@v/list",        // not escaped
+		"/dl/orel.li/!!foo/@v/list",      // escaped badly
+		"/dl/orel.li/../etc/@v/list",     // not a module path
+		"/dl/orel.li/!foo/@v/1.0.0.info", // not a version
+		"/dl/orel.li/!foo/@v/v2.0.0.zip", // wrong major version
+	} {
+		if w := get(h, path); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", path, w.Code, w.Body)
+		}
+	}
+	if w := upload(h, "orel.li/Foo", "v1.1.0", moduleZip(t, "orel.li/Foo", "v1.1.0")); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 uploading to an unescaped path, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSiblingModules(t *testing.T) {
+	h := uploadHandler(t)
+	for _, mv := range [][2]string{
+		{"orel.li/a", "v1.0.0"},
+		{"orel.li/b", "v1.1.0"},
+		{"orel.li/a/sub", "v1.2.0"},
+	} {
+		if w := upload(h, mv[0], mv[1], moduleZip(t, mv[0], mv[1])); w.Code != http.StatusOK {
+			t.Fatalf("upload of %s@%s failed: %d %s", mv[0], mv[1], w.Code, w.Body)
+		}
+	}
+
+	for modpath, want := range map[string]string{
+		"orel.li/a":     "v1.0.0",
+		"orel.li/b":     "v1.1.0",
+		"orel.li/a/sub": "v1.2.0",
+	} {
+		if w := get(h, "/dl/"+modpath+"/@v/list"); w.Body.String() != want+"\n" {
+			t.Errorf("%s: expected only %s listed, got %d %q", modpath, want, w.Code, w.Body)
+		}
+		w := get(h, "/dl/"+modpath+"/@latest")
+		var info moduleInfo
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil || info.Version != want {
+			t.Errorf("%s: expected latest %s, got %d %v", modpath, want, w.Code, info)
+		}
+	}
+	for _, path := range []string{"/dl/orel.li/c/@v/list", "/dl/orel.li/c/@latest", "/dl/orel.li/b/@v/v1.0.0.zip"} {
+		if w := get(h, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestMigrateStorage(t *testing.T) {
+	h := testHandler(t)
+	modules := h.modules()
+	old := map[string]string{
+		"orel.li/a@v1.0.0.zip":  "orel.li/a",
+		"orel.li/b@v1.1.0.zip":  "orel.li/b",
+		"orel.li/!c@v1.0.0.zip": "orel.li/C",
+	}
+	for name, modpath := range old {
+		version := strings.TrimSuffix(name[strings.LastIndex(name, "@")+1:], ".zip")
+		fname := filepath.Join(modules.dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, moduleZip(t, modpath, version), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name := range old {
+		if err := migrateZip(modules, filepath.Join(modules.dir, filepath.FromSlash(name)), false); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := migrateZip(modules, filepath.Join(modules.dir, "orel.li", "nonsense.zip"), false); err == nil {
+		t.Error("expected a zip without a version not to be migrated")
+	}
+
+	for path, want := range map[string]string{
+		"/dl/orel.li/a/@v/list":  "v1.0.0\n",
+		"/dl/orel.li/b/@v/list":  "v1.1.0\n",
+		"/dl/orel.li/!c/@v/list": "v1.0.0\n",
+	} {
+		if w := get(h, path); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: expected %q after migrating, got %d %q", path, want, w.Code, w.Body)
+		}
+	}
+}
+
+func TestVersionSidecars(t *testing.T) {
+	h := uploadHandler(t)
+	publishUpload := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/ul/orel.li/x/@v/v1.0.0.zip?"+query, bytes.NewReader(moduleZip(t, "orel.li/x", "v1.0.0")))
+		r.SetBasicAuth("alice", "hunter2")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := publishUpload("time=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad time, got %d: %s", w.Code, w.Body)
+	}
+	if w := publishUpload("time=2020-02-03T04:05:06Z"); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	// the time in the info is the one given at upload, whatever happens to
+	// the zip afterwards, and the go.mod doesn't need the zip at all
+	zipfile, err := h.modules().file("orel.li/x", "v1.0.0", ".zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zipfile, []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var info moduleInfo
+	w := get(h, "/dl/orel.li/x/@v/v1.0.0.info")
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("bad info: %d %v", w.Code, err)
+	}
+	if want := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC); !info.Time.Equal(want) {
+		t.Errorf("expected the upload time %v, got %v", want, info.Time)
+	}
+	if w := get(h, "/dl/orel.li/x/@v/v1.0.0.mod"); w.Code != http.StatusOK || w.Body.String() != "module orel.li/x\n" {
+		t.Errorf("expected the go.mod from its own file, got %d %q", w.Code, w.Body)
+	}
+	for _, path := range []string{"/dl/orel.li/x/@v/v1.1.0.info", "/dl/orel.li/x/@v/v1.1.0.mod"} {
+		if w := get(h, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestBackfillVersion(t *testing.T) {
+	h := testHandler(t)
+	modules := h.modules()
+	zipfile, err := modules.file("orel.li/x", "v1.0.0", ".zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(zipfile, moduleZip(t, "orel.li/x", "v1.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	modtime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(zipfile, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backfillVersion(modules, "orel.li/x", "v1.0.0", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".info", ".mod", ".sums"} {
+		if fname, err := modules.file("orel.li/x", "v1.0.0", ext); err != nil || missing(fname) {
+			t.Errorf("expected backfill to write a %s file", ext)
+		}
+	}
+
+	// once it's written, the info stays put when the zip is touched
+	if err := os.Chtimes(zipfile, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var info moduleInfo
+	w := get(h, "/dl/orel.li/x/@v/v1.0.0.info")
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("bad info: %d %v", w.Code, err)
+	}
+	if !info.Time.Equal(modtime) {
+		t.Errorf("expected the time of the zip when it was backfilled, %v, got %v", modtime, info.Time)
+	}
+}
+
+func TestRetractions(t *testing.T) {
+	h := uploadHandler(t)
+	for version, gomod := range map[string]string{
+		"v1.0.0": "module orel.li/x\n",
+		"v1.1.0": "module orel.li/x\n",
+		"v1.2.0": "module orel.li/x\n\nretract v1.1.0 // broken build\nretract v1.2.0 // only has retractions\n",
+	} {
+		zip := moduleZipFiles(t, "orel.li/x", version, map[string]string{"go.mod": gomod, "x.go": "package x\n"})
+		if w := upload(h, "orel.li/x", version, zip); w.Code != http.StatusOK {
+			t.Fatalf("upload of %s failed: %d %s", version, w.Code, w.Body)
+		}
+	}
+
+	if w := get(h, "/dl/orel.li/x/@v/list"); w.Body.String() != "v1.0.0\nv1.1.0\nv1.2.0\n" {
+		t.Errorf("expected retracted versions to stay listed, got %q", w.Body)
+	}
+
+	readInfo := func(path string) moduleInfo {
+		t.Helper()
+		w := get(h, path)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", path, w.Code, w.Body)
+		}
+		var info moduleInfo
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatalf("%s: bad info: %v", path, err)
+		}
+		return info
+	}
+	if info := readInfo("/dl/orel.li/x/@latest"); info.Version != "v1.0.0" || info.Retracted != nil {
+		t.Errorf("expected the latest version that isn't retracted, got %v", info)
+	}
+	if info := readInfo("/dl/orel.li/x/@v/v1.1.0.info"); len(info.Retracted) != 1 || info.Retracted[0] != "broken build" {
+		t.Errorf("expected the rationale in the info, got %v", info)
+	}
+	if info := readInfo("/dl/orel.li/x/@v/v1.0.0.info"); info.Retracted != nil {
+		t.Errorf("expected no rationale for a version that isn't retracted, got %v", info)
+	}
+
+	for _, path := range []string{"/dl/orel.li/x/@v/v1.3.0.info", "/dl/orel.li/y/@latest"} {
+		if w := get(h, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestSums(t *testing.T) {
+	h := uploadHandler(t)
+	zip := moduleZip(t, "orel.li/x", "v1.0.0")
+	if w := upload(h, "orel.li/x", "v1.0.0", zip); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+
+	fname := filepath.Join(t.TempDir(), "x.zip")
+	if err := os.WriteFile(fname, zip, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := hashVersion("orel.li/x", "v1.0.0", fname, []byte("module orel.li/x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := get(h, "/api/orel.li/x/@v/v1.0.0.sums")
+	var sums versionSums
+	if err := json.NewDecoder(w.Body).Decode(&sums); err != nil {
+		t.Fatalf("bad sums: %d %v", w.Code, err)
+	}
+	if sums != *want {
+		t.Errorf("expected sums %v, got %v", *want, sums)
+	}
+	if w := get(h, "/dl/orel.li/x/@v/v1.0.0.gosum"); w.Code != http.StatusOK || w.Body.String() != string(want.gosum()) {
+		t.Errorf("expected go.sum lines %q, got %d %q", want.gosum(), w.Code, w.Body)
+	}
+	if etag := w.Header().Get("ETag"); etag == "" || get(h, "/api/orel.li/x/@v/v1.0.0.sums").Header().Get("ETag") != etag {
+		t.Errorf("expected the same ETag every time, got %q", etag)
+	}
+
+	for path, code := range map[string]int{
+		"/api/orel.li/x/@v/v1.1.0.sums": http.StatusNotFound,
+		"/dl/orel.li/x/@v/v1.1.0.gosum": http.StatusNotFound,
+		"/api/orel.li/x/@v/latest.sums": http.StatusBadRequest,
+		"/dl/orel.li/X/@v/v1.0.0.gosum": http.StatusBadRequest,
+	} {
+		if w := get(h, path); w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+}
+
+func TestGoGet(t *testing.T) {
+	h := uploadHandler(t)
+	for _, modpath := range []string{"orel.li/a", "orel.li/a/b", "orel.li/c", "orel.li/Up", "orel.li/secret"} {
+		addVersion(t, h, modpath, "v1.0.0", "")
+	}
+	acl, err := parseAccessList(strings.NewReader("read alice orel.li/secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.acl = acl
+
+	tests := []struct {
+		path    string
+		modpath string
+		browse  string
+	}{
+		{"/a", "orel.li/a", "orel.li/a"},
+		{"/a/pkg/sub", "orel.li/a", "orel.li/a"},
+		{"/a/b", "orel.li/a/b", "orel.li/a/b"},
+		{"/a/b/pkg", "orel.li/a/b", "orel.li/a/b"},
+		{"/c/pkg", "orel.li/c", "orel.li/c"},
+		{"/Up/pkg", "orel.li/Up", "orel.li/!up"},
+	}
+	for _, tt := range tests {
+		w := get(h, tt.path+"?go-get=1")
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d: %s", tt.path, w.Code, w.Body)
+			continue
+		}
+		for _, meta := range []string{
+			fmt.Sprintf(`<meta name="go-import" content="%s mod https://orel.li/dl">`, tt.modpath),
+			fmt.Sprintf(`<meta name="go-source" content="%s https://orel.li/dl/%s/ https://orel.li/dl/%[2]s/ https://orel.li/dl/%[2]s/">`, tt.modpath, tt.browse),
+		} {
+			if !strings.Contains(w.Body.String(), meta) {
+				t.Errorf("%s: expected %s, got %s", tt.path, meta, w.Body)
+			}
+		}
+	}
+
+	for path, code := range map[string]int{
+		"/nothing/here": http.StatusNotFound,
+		"/ab":           http.StatusNotFound,
+		"/secret/pkg":   http.StatusUnauthorized,
+	} {
+		if w := get(h, path+"?go-get=1"); w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+	r := httptest.NewRequest("GET", "/secret/pkg?go-get=1", nil)
+	r.SetBasicAuth("alice", "hunter2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `content="orel.li/secret mod https://orel.li/dl"`) {
+		t.Errorf("expected alice to find the private module, got %d: %s", w.Code, w.Body)
+	}
+}
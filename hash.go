@@ -9,7 +9,9 @@ import (
 
 // pwhashcmd is just a thing for generating bcrypt hashes for passwords. This
 // is like using htpasswd from the apache-utils package but honestly adding
-// that whole package to a system to compute a single bcrypt hash is ridiculous
+// that whole package to a system to compute a single bcrypt hash is ridiculous.
+// Without any arguments, it reads the password from the terminal instead, so
+// that it doesn't end up in the shell history.
 func pwhashcmd(args []string) {
 	cost := bcrypt.DefaultCost
 
@@ -17,11 +19,29 @@ func pwhashcmd(args []string) {
 	flags.IntVar(&cost, "cost", cost, "bcrypt cost difficulty")
 	flags.Parse(args)
 
-	for _, pw := range flags.Args() {
-		hash, err := bcrypt.GenerateFromPassword([]byte(pw), cost)
+	passwords := flags.Args()
+	if len(passwords) == 0 {
+		pw, err := readPassword("password: ")
+		if err != nil {
+			bail(1, "%v", err)
+		}
+		passwords = []string{pw}
+	}
+
+	for _, pw := range passwords {
+		hash, err := hashPassword(pw, cost)
 		if err != nil {
 			bail(1, "hash failed: %v", err)
 		}
-		fmt.Println(string(hash))
+		fmt.Println(hash)
+	}
+}
+
+// hashPassword computes the bcrypt hash of a password
+func hashPassword(pw string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), cost)
+	if err != nil {
+		return "", err
 	}
+	return string(hash), nil
 }
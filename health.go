@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errDiskFreeUnsupported = errors.New("checking free disk space isn't supported here")
+
+// health is what /readyz needs to know beyond what's on disk
+type health struct {
+	// minFree is how many bytes must be free on the disk holding our root
+	minFree uint64
+
+	// drainDelay is how long we keep serving after we start failing
+	// /readyz during shutdown, so that load balancers notice before the
+	// listener goes away
+	drainDelay time.Duration
+
+	// draining is set once we've started shutting down
+	draining int32
+}
+
+// drain makes /readyz fail from now on, and waits for whatever is in front
+// of us to notice
+func (hc *health) drain() {
+	if hc == nil {
+		return
+	}
+	atomic.StoreInt32(&hc.draining, 1)
+	if hc.drainDelay > 0 {
+		log_info.Printf("draining for %v", hc.drainDelay)
+		time.Sleep(hc.drainDelay)
+	}
+}
+
+func (hc *health) isDraining() bool {
+	return hc != nil && atomic.LoadInt32(&hc.draining) != 0
+}
+
+// healthz serves /healthz, which only says that the process is up
+func (h handler) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// readyz serves /readyz, which says whether we're able to serve modules and
+// take uploads
+func (h handler) readyz(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	if h.health.isDraining() {
+		problems = append(problems, "shutting down")
+	}
+	for _, dir := range []string{"modules", "uploads"} {
+		if err := checkWritable(filepath.Join(h.root, dir)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if h.health != nil && h.health.minFree > 0 {
+		free, err := diskFree(h.root)
+		switch {
+		case err == errDiskFreeUnsupported:
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("unable to check free disk space: %v", err))
+		case free < h.health.minFree:
+			problems = append(problems, fmt.Sprintf("only %d bytes free on disk, want at least %d", free, h.health.minFree))
+		}
+	}
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// checkWritable checks that a directory exists and that we can create files
+// in it
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// isHealthCheck checks whether a request is for /healthz or /readyz, which
+// are asked for often enough to drown out everything else in the access log
+func isHealthCheck(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+}
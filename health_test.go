@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	h := testHandler(t)
+	h.health = &health{}
+
+	if rec := get(h, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("expected /healthz to be ok, saw %d", rec.Code)
+	}
+	if rec := get(h, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to fail without storage directories, saw %d", rec.Code)
+	}
+
+	for _, dir := range []string{"modules", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(h.root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec := get(h, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("expected /readyz to be ok, saw %d: %s", rec.Code, rec.Body)
+	}
+
+	h.health.drain()
+	if rec := get(h, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to fail while draining, saw %d", rec.Code)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIndexLimit is the most entries /index gives at once, the same as
+// index.golang.org
+const maxIndexLimit = 2000
+
+// indexEntry is a line of the publish log, and of the /index feed
+type indexEntry struct {
+	Path      string
+	Version   string
+	Timestamp time.Time
+}
+
+// publishLogMu keeps the timestamps in the publish log in order, so that
+// anybody following /index with the last timestamp they saw never misses an
+// entry that was appended out of order. publishLogLast has the last timestamp
+// written to each log, seeded from the end of the log the first time it's
+// written to, so that a restart doesn't go back in time.
+var (
+	publishLogMu   sync.Mutex
+	publishLogLast = make(map[string]time.Time)
+)
+
+// publishLog gives the path of the publish log, which has a line for every
+// version published to us, oldest first
+func (h handler) publishLog() string {
+	return filepath.Join(h.root, "index.log")
+}
+
+// recordPublish appends a newly published version to the publish log
+func (h handler) recordPublish(modpath, version string) error {
+	publishLogMu.Lock()
+	defer publishLogMu.Unlock()
+
+	f, err := os.OpenFile(h.publishLog(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	last, ok := publishLogLast[h.publishLog()]
+	if !ok {
+		if last, err = lastPublished(f); err != nil {
+			return fmt.Errorf("unable to read end of publish log: %w", err)
+		}
+	}
+
+	e := indexEntry{Path: modpath, Version: version, Timestamp: time.Now().UTC()}
+	if !e.Timestamp.After(last) {
+		e.Timestamp = last.Add(time.Microsecond)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	publishLogLast[h.publishLog()] = e.Timestamp
+	return nil
+}
+
+// lastPublished gives the timestamp of the last entry in a publish log, or the
+// zero time if it's empty
+func lastPublished(f *os.File) (time.Time, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	size := fi.Size()
+
+	// read backwards a block at a time until we have the whole last line
+	var tail []byte
+	for off := size; off > 0; {
+		n := int64(4096)
+		if n > off {
+			n = off
+		}
+		off -= n
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, off); err != nil {
+			return time.Time{}, err
+		}
+		tail = append(buf, tail...)
+		if i := bytes.LastIndexByte(bytes.TrimRight(tail, "\n"), '\n'); i >= 0 {
+			tail = tail[i+1:]
+			break
+		}
+	}
+	tail = bytes.TrimSpace(tail)
+	if len(tail) == 0 {
+		return time.Time{}, nil
+	}
+	var e indexEntry
+	if err := json.Unmarshal(tail, &e); err != nil {
+		return time.Time{}, fmt.Errorf("bad line in %s: %w", f.Name(), err)
+	}
+	return e.Timestamp, nil
+}
+
+// index serves /index?since=$timestamp&limit=$n, the versions published at
+// or after a time as newline-delimited JSON, in the same format as
+// index.golang.org. Versions of modules the client may not download are left
+// out.
+func (h handler) index(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeError(w, fmt.Errorf("bad since: %v: %w", err, apiError(http.StatusBadRequest)))
+			return
+		}
+		since = t
+	}
+	limit := maxIndexLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, fmt.Errorf("bad limit %q: %w", s, apiError(http.StatusBadRequest)))
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	entries, err := readPublishLog(h.publishLog(), since, limit, h.canRead(r))
+	if err != nil {
+		writeError(w, fmt.Errorf("unable to read publish log: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, max-age=60, must-revalidate")
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			log_error.Printf("%serror writing index: %v", requestPrefix(w), err)
+			return
+		}
+	}
+}
+
+// readPublishLog reads up to limit entries from the publish log with a
+// timestamp at or after since, for modules that pass the filter. Since the log
+// is in order, it starts reading at the first entry at or after since rather
+// than scanning everything published before it.
+func readPublishLog(fname string, since time.Time, limit int, keep func(modpath string) bool) ([]indexEntry, error) {
+	f, err := os.Open(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start, err := seekPublishLog(f, fi.Size(), since)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []indexEntry
+	lines := bufio.NewScanner(io.NewSectionReader(f, start, fi.Size()-start))
+	for len(entries) < limit && lines.Scan() {
+		var e indexEntry
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("bad line in %s: %w", fname, err)
+		}
+		if e.Timestamp.Before(since) || !keep(e.Path) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, lines.Err()
+}
+
+// seekPublishLog finds the offset of the first line in a publish log with a
+// timestamp at or after since, by binary search
+func seekPublishLog(f *os.File, size int64, since time.Time) (int64, error) {
+	if since.IsZero() {
+		return 0, nil
+	}
+
+	// lineAt gives the offset and timestamp of the first line that starts
+	// at or after off, or the end of the file
+	lineAt := func(off int64) (int64, time.Time, error) {
+		r := bufio.NewReader(io.NewSectionReader(f, off, size-off))
+		start := off
+		if off > 0 {
+			// back up a byte so a line starting right at off isn't skipped
+			r = bufio.NewReader(io.NewSectionReader(f, off-1, size-off+1))
+			skipped, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				return size, time.Time{}, nil
+			}
+			if err != nil {
+				return 0, time.Time{}, err
+			}
+			start = off - 1 + int64(len(skipped))
+		}
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			return size, time.Time{}, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, time.Time{}, err
+		}
+		var e indexEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return 0, time.Time{}, fmt.Errorf("bad line in %s: %w", f.Name(), err)
+		}
+		return start, e.Timestamp, nil
+	}
+
+	var searchErr error
+	off := sort.Search(int(size), func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		start, t, err := lineAt(int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return start == size || !t.Before(since)
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	start, _, err := lineAt(int64(off))
+	return start, err
+}
+
+// backfillPublishLog writes a publish log for versions that were uploaded
+// before we kept one, oldest first by the time in their info. It's only
+// written if there's no log at all, since otherwise the versions in it
+// would be out of order.
+func backfillPublishLog(root string, modules store, dryRun bool) error {
+	fname := filepath.Join(root, "index.log")
+	if !missing(fname) {
+		return nil
+	}
+
+	paths, err := modules.modules()
+	if err != nil {
+		return err
+	}
+	var entries []indexEntry
+	for _, modpath := range paths {
+		versions, err := modules.versions(modpath)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			info, err := modules.readInfo(modpath, version)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, indexEntry{Path: modpath, Version: version, Timestamp: info.Time.UTC()})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+
+	log_info.Printf("writing %s with %d versions", fname, len(entries))
+	if dryRun || len(entries) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	return writeFile(fname, buf)
+}
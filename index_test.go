@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readIndex gets /index with the given query, giving the entries in it
+func readIndex(t *testing.T, h handler, query string) []indexEntry {
+	t.Helper()
+	w := get(h, "/index?"+query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/index?%s: expected 200, got %d: %s", query, w.Code, w.Body)
+	}
+	var entries []indexEntry
+	lines := bufio.NewScanner(w.Body)
+	for lines.Scan() {
+		var e indexEntry
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatalf("/index?%s: bad line %q: %v", query, lines.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestIndex(t *testing.T) {
+	h := uploadHandler(t)
+	if entries := readIndex(t, h, ""); len(entries) != 0 {
+		t.Errorf("expected an empty index before anything is published, got %v", entries)
+	}
+
+	published := []string{"orel.li/a@v1.0.0", "orel.li/b@v0.1.0", "orel.li/a@v1.1.0", "orel.li/secret@v1.0.0"}
+	for _, mv := range published {
+		modpath, version, _ := strings.Cut(mv, "@")
+		if w := upload(h, modpath, version, moduleZip(t, modpath, version)); w.Code != http.StatusOK {
+			t.Fatalf("upload of %s failed: %d %s", mv, w.Code, w.Body)
+		}
+	}
+	// a failed upload isn't published
+	upload(h, "orel.li/a", "v1.2.0", []byte("not a zip"))
+
+	acl, err := parseAccessList(strings.NewReader("read authenticated orel.li/secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.acl = acl
+
+	entries := readIndex(t, h, "")
+	var got []string
+	for i, e := range entries {
+		got = append(got, e.Path+"@"+e.Version)
+		if i > 0 && !e.Timestamp.After(entries[i-1].Timestamp) {
+			t.Errorf("expected timestamps to increase, got %v after %v", e.Timestamp, entries[i-1].Timestamp)
+		}
+	}
+	if strings.Join(got, " ") != strings.Join(published[:3], " ") {
+		t.Fatalf("expected index %v, got %v", published[:3], got)
+	}
+
+	since := url.QueryEscape(entries[1].Timestamp.Format(time.RFC3339Nano))
+	if rest := readIndex(t, h, "since="+since); len(rest) != 2 || rest[0] != entries[1] {
+		t.Errorf("expected the entries since the second one, got %v", rest)
+	}
+	if first := readIndex(t, h, "limit=1"); len(first) != 1 || first[0] != entries[0] {
+		t.Errorf("expected only the first entry, got %v", first)
+	}
+	if later := readIndex(t, h, "since=2999-01-01T00:00:00Z"); len(later) != 0 {
+		t.Errorf("expected nothing published in the future, got %v", later)
+	}
+
+	for _, query := range []string{"since=yesterday", "limit=0", "limit=x"} {
+		if w := get(h, "/index?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("/index?%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestBackfillPublishLog(t *testing.T) {
+	h := testHandler(t)
+	addVersion(t, h, "orel.li/old", "v1.0.0", "")
+	addVersion(t, h, "orel.li/old", "v1.1.0", "")
+
+	if err := backfillPublishLog(h.root, h.modules(), false); err != nil {
+		t.Fatal(err)
+	}
+	entries := readIndex(t, h, "")
+	if len(entries) != 2 || entries[0].Version != "v1.0.0" || entries[1].Version != "v1.1.0" {
+		t.Errorf("expected both versions in the backfilled index, got %v", entries)
+	}
+
+	// once there's a log, backfill leaves it alone
+	addVersion(t, h, "orel.li/old", "v1.2.0", "")
+	if err := backfillPublishLog(h.root, h.modules(), false); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readIndex(t, h, ""); len(entries) != 2 {
+		t.Errorf("expected backfill to leave the log alone, got %v", entries)
+	}
+}
+
+func TestPublishLogRestart(t *testing.T) {
+	h := uploadHandler(t)
+
+	// a log left behind by an earlier run, with a clock that was ahead of
+	// ours
+	ahead := time.Now().Add(time.Hour).UTC()
+	b, err := json.Marshal(indexEntry{Path: "orel.li/a", Version: "v1.0.0", Timestamp: ahead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(h.publishLog(), append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := upload(h, "orel.li/a", "v1.1.0", moduleZip(t, "orel.li/a", "v1.1.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	entries := readIndex(t, h, "")
+	if len(entries) != 2 || !entries[1].Timestamp.After(ahead) {
+		t.Errorf("expected the new version after the one already in the log, got %v", entries)
+	}
+}
+
+func TestReadPublishLogSince(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf []byte
+	for i := 0; i < 100; i++ {
+		b, err := json.Marshal(indexEntry{Path: "orel.li/m", Version: fmt.Sprintf("v1.%d.0", i), Timestamp: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	fname := filepath.Join(t.TempDir(), "index.log")
+	if err := os.WriteFile(fname, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	all := func(string) bool { return true }
+
+	for _, i := range []int{0, 1, 37, 99} {
+		since := start.Add(time.Duration(i) * time.Minute)
+		for _, at := range []time.Time{since, since.Add(-time.Second)} {
+			entries, err := readPublishLog(fname, at, 3, all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) == 0 || entries[0].Version != fmt.Sprintf("v1.%d.0", i) {
+				t.Errorf("since %v: expected to start at v1.%d.0, got %v", at, i, entries)
+			}
+			if len(entries) > 3 {
+				t.Errorf("since %v: expected at most 3 entries, got %d", at, len(entries))
+			}
+		}
+	}
+	if entries, err := readPublishLog(fname, start.Add(time.Hour*24), 3, all); err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing after the last entry, got %v %v", entries, err)
+	}
+}
@@ -7,4 +7,9 @@ import (
 type moduleInfo struct {
 	Version string
 	Time    time.Time
+
+	// Retracted holds the rationale for each retract directive covering this
+	// version, as listed in the go.mod of the module's latest version. It's
+	// filled in when serving the info and is never stored.
+	Retracted []string `json:",omitempty"`
 }
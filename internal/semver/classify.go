@@ -0,0 +1,45 @@
+package semver
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pseudoRE matches the pseudo-versions that the go command generates for
+// untagged commits, e.g. v0.0.0-20191109021931-daa7c04131f5
+var pseudoRE = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)\d{14}-[A-Za-z0-9]+(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// IsRelease reports whether v is a valid semantic version without a
+// prerelease suffix, such as v1.2.3 or v2.0.0+incompatible.
+func IsRelease(v string) bool {
+	return IsValid(v) && Prerelease(v) == ""
+}
+
+// IsPrerelease reports whether v is a valid semantic version with a
+// prerelease suffix that is not a pseudo-version, such as v1.3.0-rc.1.
+func IsPrerelease(v string) bool {
+	return IsValid(v) && Prerelease(v) != "" && !IsPseudo(v)
+}
+
+// IsPseudo reports whether v is a pseudo-version.
+func IsPseudo(v string) bool {
+	return strings.Count(v, "-") >= 2 && IsValid(v) && pseudoRE.MatchString(v)
+}
+
+// IsIncompatible reports whether v has the +incompatible suffix that marks a
+// major version above v1 of a module without a go.mod file.
+func IsIncompatible(v string) bool {
+	return IsValid(v) && Build(v) == "+incompatible"
+}
+
+// PseudoTimestamp returns the yyyymmddhhmmss timestamp of the pseudo-version
+// v. Timestamps of the same length sort in time order as strings.
+// If v is not a pseudo-version, PseudoTimestamp returns the empty string.
+func PseudoTimestamp(v string) string {
+	if !IsPseudo(v) {
+		return ""
+	}
+	v = strings.TrimSuffix(v, Build(v))
+	j := strings.LastIndex(v, "-")
+	return v[j-14 : j]
+}
@@ -0,0 +1,45 @@
+package semver
+
+import (
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	var tests = []struct {
+		in           string
+		release      bool
+		prerelease   bool
+		pseudo       bool
+		incompatible bool
+		timestamp    string
+	}{
+		{"bad", false, false, false, false, ""},
+		{"v1.2.3", true, false, false, false, ""},
+		{"v1.2.3+meta", true, false, false, false, ""},
+		{"v2.0.0+incompatible", true, false, false, true, ""},
+		{"v1.3.0-rc.1", false, true, false, false, ""},
+		{"v2.1.0-pre+incompatible", false, true, false, true, ""},
+		{"v0.0.0-20191109021931-daa7c04131f5", false, false, true, false, "20191109021931"},
+		{"v1.2.4-0.20191109021931-daa7c04131f5", false, false, true, false, "20191109021931"},
+		{"v1.2.3-pre.0.20191109021931-daa7c04131f5", false, false, true, false, "20191109021931"},
+		{"v2.0.0-20191109021931-daa7c04131f5+incompatible", false, false, true, true, "20191109021931"},
+	}
+
+	for _, tt := range tests {
+		if got := IsRelease(tt.in); got != tt.release {
+			t.Errorf("IsRelease(%q) = %v, want %v", tt.in, got, tt.release)
+		}
+		if got := IsPrerelease(tt.in); got != tt.prerelease {
+			t.Errorf("IsPrerelease(%q) = %v, want %v", tt.in, got, tt.prerelease)
+		}
+		if got := IsPseudo(tt.in); got != tt.pseudo {
+			t.Errorf("IsPseudo(%q) = %v, want %v", tt.in, got, tt.pseudo)
+		}
+		if got := IsIncompatible(tt.in); got != tt.incompatible {
+			t.Errorf("IsIncompatible(%q) = %v, want %v", tt.in, got, tt.incompatible)
+		}
+		if got := PseudoTimestamp(tt.in); got != tt.timestamp {
+			t.Errorf("PseudoTimestamp(%q) = %q, want %q", tt.in, got, tt.timestamp)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"orel.li/mir/internal/semver"
+)
+
+// latestVersion picks the version that @latest reports out of a sorted list
+// of versions, following the same rules as the go command: the highest
+// release, or failing that the highest prerelease, or failing that the most
+// recent pseudo-version. Like the go command, +incompatible versions only
+// count when there's no compatible release or prerelease at all, since the
+// highest compatible version has a go.mod file: every .mod we serve does,
+// even for a zip without one.
+func latestVersion(versions []string) string {
+	compatible := false
+	for _, v := range versions {
+		if !semver.IsPseudo(v) && !semver.IsIncompatible(v) {
+			compatible = true
+			break
+		}
+	}
+
+	for _, kind := range []func(string) bool{semver.IsRelease, semver.IsPrerelease} {
+		var latest string
+		for _, v := range versions {
+			if kind(v) && !(compatible && semver.IsIncompatible(v)) {
+				latest = v
+			}
+		}
+		if latest != "" {
+			return latest
+		}
+	}
+
+	// pseudo-versions are ordered by when their commit was made, which isn't
+	// necessarily the order of their base versions
+	var newest string
+	for _, v := range versions {
+		if !semver.IsPseudo(v) {
+			continue
+		}
+		if newest == "" || semver.PseudoTimestamp(v) >= semver.PseudoTimestamp(newest) {
+			newest = v
+		}
+	}
+	return newest
+}
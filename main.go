@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 var (
@@ -31,7 +32,7 @@ var usage string
 
 func sigCancel(ctx context.Context) context.Context {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	ctx, cancel := context.WithCancel(ctx)
 	onShutdown(func() error { cancel(); return nil })
@@ -66,10 +67,24 @@ func main() {
 	switch root.Arg(0) {
 	case "serve":
 		serve(rest)
+	case "config":
+		configcmd(rest)
 	case "zip":
 		zipcmd(rest)
 	case "pwhash":
 		pwhashcmd(rest)
+	case "token":
+		tokencmd(rest)
+	case "user":
+		usercmd(rest)
+	case "yank", "delete", "restore":
+		admincmd(root.Arg(0), rest)
+	case "sumdb-keygen":
+		sumdbkeygencmd(rest)
+	case "backfill":
+		backfillcmd(rest)
+	case "migrate-storage":
+		migratecmd(rest)
 	case "next":
 		nextcmd(rest)
 		// mir next major
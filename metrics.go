@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is a small implementation of the Prometheus text exposition format,
+// since the official client library would bring in a pile of github.com
+// dependencies for what amounts to a few maps of numbers.
+
+var (
+	httpRequests = newCounter("mir_http_requests_total",
+		"HTTP requests served, by endpoint and status code.", "endpoint", "code")
+	httpDuration = newHistogram("mir_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by endpoint and status code.", durationBuckets, "endpoint", "code")
+	httpBytes = newCounter("mir_http_response_bytes_total",
+		"Bytes written in HTTP response bodies, by endpoint.", "endpoint")
+	uploads = newCounter("mir_uploads_total",
+		"Module versions published.")
+	uploadSize = newHistogram("mir_upload_size_bytes",
+		"Size of published module zips.", sizeBuckets)
+	uploadRejections = newCounter("mir_upload_verification_failures_total",
+		"Uploads rejected because the zip isn't a valid module.")
+	authFailures = newCounter("mir_auth_failures_total",
+		"Requests that failed to authenticate, by the kind of credentials they had.", "method")
+	bcryptDuration = newHistogram("mir_bcrypt_duration_seconds",
+		"Time spent checking bcrypt password hashes.", durationBuckets)
+)
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 5e8}
+)
+
+// metric is something that can write itself in the text format
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// registry is every metric we have, in the order they were created
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels formats label names and values, with any extra label on the
+// end
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter is a number that only goes up
+type counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// add adds to the counter with the given label values
+func (c *counter) add(v float64, labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelKey(labels)] += v
+}
+
+func (c *counter) inc(labels ...string) { c.add(1, labels...) }
+
+func (c *counter) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, k), formatFloat(c.values[k]))
+	}
+}
+
+// histogram counts observations into buckets
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*histogramSeries)}
+	register(h)
+	return h
+}
+
+// observe records a value with the given label values
+func (h *histogram) observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := labelKey(labels)
+	s := h.series[k]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// since observes the seconds since start
+func (h *histogram) since(start time.Time, labels ...string) {
+	h.observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// storageSizes measures how much disk each stored module takes up. Walking
+// the whole store isn't cheap, so the result is kept for a minute.
+type storageSizes struct {
+	modules store
+
+	// acl leaves out the modules that not everybody may download, since a
+	// metric naming one gives away that it exists
+	acl *accessList
+
+	mu       sync.Mutex
+	measured time.Time
+	sizes    map[string]int64
+}
+
+func (s *storageSizes) writeTo(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.measured) > time.Minute {
+		sizes, err := s.measure()
+		if err != nil {
+			log_error.Printf("unable to measure module storage: %v", err)
+		} else {
+			s.sizes, s.measured = sizes, time.Now()
+		}
+	}
+
+	const name = "mir_module_storage_bytes"
+	fmt.Fprintf(w, "# HELP %s Disk space taken by each hosted module.\n# TYPE %s gauge\n", name, name)
+	for _, modpath := range sortedKeys(s.sizes) {
+		fmt.Fprintf(w, "%s{module=%q} %d\n", name, modpath, s.sizes[modpath])
+	}
+}
+
+func (s *storageSizes) measure() (map[string]int64, error) {
+	paths, err := s.modules.modules()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(paths))
+	for _, modpath := range paths {
+		if !s.acl.public(modpath) {
+			continue
+		}
+		dir, err := s.modules.versionDir(modpath)
+		if err != nil {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if fi, err := e.Info(); err == nil && fi.Mode().IsRegular() {
+				sizes[modpath] += fi.Size()
+			}
+		}
+	}
+	return sizes, nil
+}
+
+// metricsHandler serves every metric in the text format
+type metricsHandler struct {
+	storage *storageSizes
+}
+
+// newMetricsHandler creates a metrics handler. Metrics served where anybody
+// can see them should be given the access list, so that they leave out
+// private modules.
+func newMetricsHandler(modules store, acl *accessList) metricsHandler {
+	return metricsHandler{storage: &storageSizes{modules: modules, acl: acl}}
+}
+
+func (m metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+	m.storage.writeTo(w)
+}
+
+// instrument gives a handler that records the count, duration, and size of
+// the responses to every request that h serves
+func (h handler) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		endpoint := h.endpoint(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		code := strconv.Itoa(rec.status)
+		httpRequests.inc(endpoint, code)
+		httpDuration.since(start, endpoint, code)
+		httpBytes.add(float64(rec.bytes), endpoint)
+	})
+}
+
+// endpoint names the endpoint that a request is for, to label metrics with.
+// There are only a handful of these, so that a metric doesn't grow a series
+// for every module path anybody asks for.
+func (h handler) endpoint(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case r.URL.Query().Get("go-get") == "1":
+		return "go-get"
+	case h.sumdb != nil && h.sumdb.serves(p):
+		return "sumdb"
+	case p == "/metrics":
+		return "metrics"
+	case p == "/healthz":
+		return "healthz"
+	case p == "/readyz":
+		return "readyz"
+	case p == "/index":
+		return "index"
+	case listP.MatchString(p):
+		return "list"
+	case latestP.MatchString(p):
+		return "latest"
+	case infoP.MatchString(p):
+		return "info"
+	case modP.MatchString(p):
+		return "mod"
+	case zipP.MatchString(p):
+		return "zip"
+	case gosumP.MatchString(p):
+		return "gosum"
+	case sumsP.MatchString(p):
+		return "sums"
+	case uploadP.MatchString(p):
+		return "upload"
+	case adminP.MatchString(p):
+		return "admin"
+	case browseIndexP.MatchString(p), browseModuleP.MatchString(p), browseVersionP.MatchString(p):
+		return "browse"
+	case docP.MatchString(p), docLatestP.MatchString(p):
+		return "doc"
+	}
+	return "other"
+}
+
+// serveMetrics serves metrics on a listener of their own, so that they can be
+// kept off of the public one
+func serveMetrics(addr string, m http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics listener: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := http.Server{Handler: mux}
+	onShutdown(func() error { return server.Close() })
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log_error.Printf("metrics server: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	h := testHandler(t)
+	h.metrics = newMetricsHandler(h.modules(), nil)
+	addVersion(t, h, "orel.li/metered", "v1.0.0", "")
+
+	served := h.instrument(h)
+	served.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/dl/orel.li/metered/@v/list", nil))
+	served.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/dl/orel.li/nothing/@v/list", nil))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE mir_http_requests_total counter\n",
+		`mir_http_requests_total{endpoint="list",code="200"} `,
+		`mir_http_requests_total{endpoint="list",code="404"} `,
+		`mir_http_request_duration_seconds_bucket{endpoint="list",code="200",le="+Inf"} `,
+		`mir_http_response_bytes_total{endpoint="list"} `,
+		"# TYPE mir_uploads_total counter\nmir_uploads_total ",
+		`mir_module_storage_bytes{module="orel.li/metered"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestMetricsHidePrivateModules(t *testing.T) {
+	h := testHandler(t)
+	addVersion(t, h, "orel.li/open", "v1.0.0", "")
+	addVersion(t, h, "orel.li/secret", "v1.0.0", "")
+	acl, err := parseAccessList(strings.NewReader("read authenticated orel.li/secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.acl = acl
+	h.metrics = newMetricsHandler(h.modules(), h.acl)
+
+	body := get(h, "/metrics").Body.String()
+	if !strings.Contains(body, `mir_module_storage_bytes{module="orel.li/open"} `) {
+		t.Errorf("expected the public module in the metrics")
+	}
+	if strings.Contains(body, "orel.li/secret") {
+		t.Errorf("expected the private module to be left out of the metrics")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := &histogram{name: "test_seconds", help: "A test.", buckets: []float64{1, 2}, series: make(map[string]*histogramSeries)}
+	for _, v := range []float64{0.5, 1.5, 3} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	h.writeTo(&b)
+	want := `# HELP test_seconds A test.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="2"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5
+test_seconds_count 3
+`
+	if b.String() != want {
+		t.Errorf("saw\n%s\nexpected\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// migratecmd moves zips stored in the old flat layout,
+//
+//	$root/modules/$dir/$basename@$version.zip
+//
+// into the GOPROXY-style layout that the server reads from now. In the flat
+// layout, modules that share a parent directory also shared a directory of
+// zips, so we couldn't tell their versions apart.
+func migratecmd(args []string) {
+	var (
+		rootDir = "/srv/mir"
+		dryRun  bool
+	)
+
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	flags.StringVar(&rootDir, "root", rootDir, "root directory for module storage")
+	flags.BoolVar(&dryRun, "n", false, "print what would be moved without moving anything")
+	flags.Parse(args)
+
+	modules := store{dir: filepath.Join(rootDir, "modules")}
+
+	var old []string
+	err := filepath.WalkDir(modules.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "@v" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(p) == ".zip" {
+			old = append(old, p)
+		}
+		return nil
+	})
+	if err != nil {
+		bail(1, "unable to scan module directory: %v", err)
+	}
+
+	var failed int
+	for _, p := range old {
+		if err := migrateZip(modules, p, dryRun); err != nil {
+			log_error.Printf("unable to migrate %s: %v", p, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		bail(1, "failed to migrate %d of %d files", failed, len(old))
+	}
+	log_info.Printf("migrated %d files", len(old))
+}
+
+// migrateZip moves a single zip from the flat layout into the module store
+func migrateZip(modules store, p string, dryRun bool) error {
+	rel, err := filepath.Rel(modules.dir, p)
+	if err != nil {
+		return err
+	}
+	rel = strings.TrimSuffix(filepath.ToSlash(rel), ".zip")
+
+	i := strings.LastIndex(rel, "@")
+	if i < 0 {
+		return fmt.Errorf("file name has no version")
+	}
+
+	// zips uploaded before we started escaping paths were stored with their
+	// names as-is, so accept either form
+	modpath, err := module.UnescapePath(rel[:i])
+	if err != nil {
+		modpath = rel[:i]
+	}
+	version, err := module.UnescapeVersion(rel[i+1:])
+	if err != nil {
+		version = rel[i+1:]
+	}
+	if err := module.Check(modpath, version); err != nil {
+		return err
+	}
+
+	dest, err := modules.file(modpath, version, ".zip")
+	if err != nil {
+		return err
+	}
+
+	switch _, err := os.Stat(dest); {
+	case err == nil:
+		return fmt.Errorf("%s already exists", dest)
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return err
+	}
+
+	log_info.Printf("%s@%s: %s -> %s", modpath, version, p, dest)
+	if dryRun {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(p, dest)
+}
@@ -45,7 +45,7 @@ func nextcmd(args []string) {
 
 	u, err := url.Parse(f.Module.Mod.Path)
 	if err != nil {
-		bail(1, "module path %s is not a valid url: %v", err)
+		bail(1, "module path %s is not a valid url: %v", modpath, err)
 	}
 	u.Scheme = "https"
 
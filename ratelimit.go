@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limits protects us from clients that ask for too much: a token bucket for
+// uploads from each client address and each user, a cap on how many uploads
+// run at once, and a lockout for addresses and users that keep failing to
+// authenticate. Any of them can be left off.
+type limits struct {
+	uploads     *rateLimiter
+	uploadSlots chan struct{}
+	lockout     *lockout
+}
+
+// tooManyRequests is an error for a request that's over a limit
+type tooManyRequests struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e tooManyRequests) Error() string {
+	return fmt.Sprintf("%s, retry in %v", e.reason, e.retryAfter.Round(time.Second))
+}
+
+func (e tooManyRequests) Unwrap() error {
+	return apiError(http.StatusTooManyRequests)
+}
+
+// retryAfterHeader gives the value of a Retry-After header for the error
+func (e tooManyRequests) retryAfterHeader() string {
+	return strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds())))
+}
+
+// checkLockout fails if the client address or the username a request is for
+// has been locked out
+func (l *limits) checkLockout(ip, user string) error {
+	if l == nil || l.lockout == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, key := range lockoutKeys(ip, user) {
+		if wait := l.lockout.locked(key, now); wait > 0 {
+			return tooManyRequests{reason: "too many failed logins", retryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// authFailed records a failed login
+func (l *limits) authFailed(ip, user string) {
+	if l == nil || l.lockout == nil {
+		return
+	}
+	now := time.Now()
+	for _, key := range lockoutKeys(ip, user) {
+		if l.lockout.fail(key, now) {
+			log_error.Printf("locking out %s for %v after %d failed logins", key, l.lockout.duration, l.lockout.failures)
+		}
+	}
+}
+
+// authSucceeded forgets earlier failed logins for the user that logged in.
+// The address keeps its failures, or else an attacker with an account of
+// their own could keep wiping them out between guesses.
+func (l *limits) authSucceeded(user string) {
+	if l == nil || l.lockout == nil || user == "" {
+		return
+	}
+	l.lockout.reset("user " + user)
+}
+
+func lockoutKeys(ip, user string) []string {
+	keys := clientKeys(ip)
+	if user != "" {
+		keys = append(keys, "user "+user)
+	}
+	return keys
+}
+
+// clientKeys gives the key for a client address, unless it's the unix
+// socket. Everything that comes in over the socket has the same address
+// unless a proxy we trust tells us otherwise, and one client there shouldn't
+// get all of them locked out or throttled.
+func clientKeys(ip string) []string {
+	if ip == "unix" {
+		return nil
+	}
+	return []string{"address " + ip}
+}
+
+// startUpload checks that a client may start an upload, giving a function
+// to call when the upload is done
+func (l *limits) startUpload(ip, user string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if l.uploads != nil {
+		now := time.Now()
+		for _, key := range append(clientKeys(ip), "user "+user) {
+			if wait := l.uploads.take(key, now); wait > 0 {
+				return nil, tooManyRequests{reason: fmt.Sprintf("too many uploads from %s", key), retryAfter: wait}
+			}
+		}
+	}
+	if l.uploadSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.uploadSlots <- struct{}{}:
+		return func() { <-l.uploadSlots }, nil
+	default:
+		return nil, tooManyRequests{reason: "too many uploads at once", retryAfter: time.Second}
+	}
+}
+
+// rateLimiter is a set of token buckets, one per key. Every bucket starts
+// full, and refills at a steady rate.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take takes a token from a bucket, or says how long until there'll be one
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have filled back up, every so often, so that
+// we don't keep one for every address that has ever talked to us
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// lockout locks a key out for a while once it has failed too many times in a
+// row. Failures older than the lockout duration are forgotten.
+type lockout struct {
+	failures int
+	duration time.Duration
+
+	mu    sync.Mutex
+	state map[string]*failureCount
+	swept time.Time
+}
+
+type failureCount struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func newLockout(failures int, duration time.Duration) *lockout {
+	return &lockout{failures: failures, duration: duration, state: make(map[string]*failureCount)}
+}
+
+// locked says how much longer a key is locked out for
+func (l *lockout) locked(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f := l.state[key]; f != nil && now.Before(f.until) {
+		return f.until.Sub(now)
+	}
+	return 0
+}
+
+// fail records a failure, saying whether it locked the key out
+func (l *lockout) fail(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	f := l.state[key]
+	if f == nil || now.Sub(f.last) > l.duration {
+		f = &failureCount{}
+		l.state[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= l.failures {
+		f.count = 0
+		f.until = now.Add(l.duration)
+		return true
+	}
+	return false
+}
+
+func (l *lockout) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.state, key)
+}
+
+func (l *lockout) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, f := range l.state {
+		if now.Sub(f.last) > l.duration && now.After(f.until) {
+			delete(l.state, key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60, 2)
+	now := time.Now()
+	if l.take("a", now) != 0 || l.take("a", now) != 0 {
+		t.Fatal("expected a full bucket to allow a burst")
+	}
+	if wait := l.take("a", now); wait <= 0 || wait > time.Second {
+		t.Errorf("expected to wait up to a second for a token, saw %v", wait)
+	}
+	if l.take("b", now) != 0 {
+		t.Error("expected buckets to be separate")
+	}
+	if l.take("a", now.Add(time.Second)) != 0 {
+		t.Error("expected the bucket to refill")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	h := testHandler(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.auth["alice"] = string(hash)
+	h.limits = &limits{lockout: newLockout(3, time.Minute)}
+
+	login := func(addr, pass string) error {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = addr + ":1234"
+		r.SetBasicAuth("alice", pass)
+		_, err := h.authenticate(r, scopePublish, "orel.li/mir")
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := login("192.0.2.1", "guess"); err == nil {
+			t.Fatal("expected a bad password to fail")
+		}
+	}
+
+	// alice is locked out from everywhere, even with the right password
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		err := login(addr, "hunter2")
+		var tooMany tooManyRequests
+		if !errors.As(err, &tooMany) {
+			t.Fatalf("expected a lockout from %s, saw %v", addr, err)
+		}
+		rec := httptest.NewRecorder()
+		writeError(rec, err)
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("expected a 429 with Retry-After, saw %d %v", rec.Code, rec.Header())
+		}
+	}
+}
+
+func TestLockoutKeys(t *testing.T) {
+	h := testHandler(t)
+	for _, user := range []string{"alice", "mallory"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user+"-pw"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.auth[user] = string(hash)
+	}
+	h.limits = &limits{lockout: newLockout(3, time.Minute)}
+
+	login := func(remote, user, pass string) error {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remote
+		r.SetBasicAuth(user, pass)
+		_, err := h.authenticate(r, scopePublish, "orel.li/mir")
+		return err
+	}
+	isLockout := func(err error) bool {
+		var tooMany tooManyRequests
+		return errors.As(err, &tooMany)
+	}
+
+	// logging in as yourself doesn't wipe out the failures of your address
+	for i := 0; i < 2; i++ {
+		login("192.0.2.1:1234", "alice", "guess")
+		if err := login("192.0.2.1:1234", "mallory", "mallory-pw"); err != nil {
+			t.Fatalf("expected mallory to log in, saw %v", err)
+		}
+	}
+	login("192.0.2.1:1234", "bob", "guess")
+	if err := login("192.0.2.1:1234", "mallory", "mallory-pw"); !isLockout(err) {
+		t.Errorf("expected the address to be locked out, saw %v", err)
+	}
+
+	// everybody on the unix socket has the same address, so it's not locked
+	// out, and only the user being guessed at is
+	for i := 0; i < 3; i++ {
+		login("@", "mallory", "guess")
+	}
+	if err := login("@", "alice", "alice-pw"); err != nil {
+		t.Errorf("expected alice to log in over the unix socket, saw %v", err)
+	}
+	if err := login("@", "mallory", "mallory-pw"); !isLockout(err) {
+		t.Errorf("expected mallory to be locked out, saw %v", err)
+	}
+}
+
+func TestUnixUploadLimit(t *testing.T) {
+	l := &limits{uploads: newRateLimiter(60, 1)}
+	if _, err := l.startUpload("unix", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.startUpload("unix", "bob"); err != nil {
+		t.Errorf("expected bob's upload over the unix socket not to be limited by alice's, saw %v", err)
+	}
+	if _, err := l.startUpload("unix", "alice"); err == nil {
+		t.Error("expected alice's second upload to be limited")
+	}
+}
+
+func TestConcurrentUploadLimit(t *testing.T) {
+	l := &limits{uploadSlots: make(chan struct{}, 1)}
+	done, err := l.startUpload("192.0.2.1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.startUpload("192.0.2.2", "bob"); err == nil {
+		t.Error("expected a second upload at once to fail")
+	}
+	done()
+	if _, err := l.startUpload("192.0.2.2", "bob"); err != nil {
+		t.Errorf("expected an upload after the first finished to start, saw %v", err)
+	}
+}
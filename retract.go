@@ -0,0 +1,61 @@
+package main
+
+import (
+	"golang.org/x/mod/modfile"
+
+	"orel.li/mir/internal/semver"
+)
+
+// retractions holds the retract directives that apply to a module. These
+// come from the go.mod of the module's latest version, the same as the go
+// command reads them.
+type retractions []*modfile.Retract
+
+// retractions reads the retract directives for a module given all of its
+// stored versions
+func (s store) retractions(modpath string, versions []string) (retractions, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	latest := latestVersion(versions)
+
+	b, err := s.readMod(modpath, latest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := modfile.ParseLax("go.mod", b, nil)
+	if err != nil {
+		return nil, err
+	}
+	return retractions(f.Retract), nil
+}
+
+// rationale gives the rationale for every retraction that covers a version.
+// A nil result means the version isn't retracted.
+func (r retractions) rationale(version string) []string {
+	var reasons []string
+	for _, rt := range r {
+		if semver.Compare(rt.Low, version) > 0 || semver.Compare(version, rt.High) > 0 {
+			continue
+		}
+		// the go command shows the same thing when there's no comment
+		reason := rt.Rationale
+		if reason == "" {
+			reason = "retracted by module author"
+		}
+		reasons = append(reasons, reason)
+	}
+	return reasons
+}
+
+// filter gives the versions that are not retracted
+func (r retractions) filter(versions []string) []string {
+	keep := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if r.rationale(v) == nil {
+			keep = append(keep, v)
+		}
+	}
+	return keep
+}
@@ -1,43 +1,134 @@
 package main
 
 import (
-	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 func serve(args []string) {
-	// listen on this unix domain socket
-	var socketPath string
-
-	// serve modules out of this root directory
-	rootDir := "/srv/mir"
-
-	// serve module traffic on this hostname
-	var hostname string
-	var httpAddr string
-	auth := make(authUsers)
-
-	serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
-	serveFlags.StringVar(&socketPath, "unix", socketPath, "path for a unix domain socket to listen on")
-	serveFlags.StringVar(&httpAddr, "http", httpAddr, "http address to listen on")
-	serveFlags.StringVar(&rootDir, "root", rootDir, "root directory for module storage")
-	serveFlags.StringVar(&hostname, "hostname", hostname, "domain name on which mir serves modules")
-	serveFlags.Var(&auth, "auth-users", "comma-separated list of usernames and bcrypt password hashes")
-	serveFlags.Parse(args)
+	c, auth := parseServeFlags("serve", args)
+	if err := c.check(); err != nil {
+		bail(1, "bad config:\n%v", err)
+	}
 
 	h := handler{
-		socketPath: socketPath,
-		httpAddr:   httpAddr,
-		root:       rootDir,
-		hostname:   hostname,
+		socketPath: c.Listen.Unix,
+		httpAddr:   c.Listen.HTTP,
+		root:       c.Root,
+		hostname:   c.Hostname,
+		tlsCert:    c.TLS.CertFile,
+		tlsKey:     c.TLS.KeyFile,
 		auth:       auth,
+		tokens:     newTokenFile(c.Root),
+		docs:       newDocCache(filepath.Join(c.Root, "docs")),
+	}
+	accessLog, err := openAccessLog(c.AccessLog.File, c.AccessLog.Format)
+	if err != nil {
+		bail(1, "unable to open access log: %v", err)
+	}
+	accessLog.healthChecks = c.AccessLog.HealthChecks
+	h.accessLog = accessLog
+	h.limits = c.limits()
+	if c.Listen.TrustedProxies != "" {
+		proxies, err := parseTrustedProxies(c.Listen.TrustedProxies)
+		if err != nil {
+			bail(1, "bad trusted proxies: %v", err)
+		}
+		h.proxies = proxies
+	}
+	if c.Listen.Unix != "" && !h.proxies.trusts("unix") {
+		log_error.Printf("WARNING: every client on the unix socket has the same address, so rate limits and lockouts only apply per user. If a reverse proxy in front of us sets X-Forwarded-For, add unix to -trusted-proxies.")
+	}
+	h.health = &health{minFree: c.Health.MinFreeMB << 20}
+	if c.Health.DrainDelay != "" {
+		d, err := time.ParseDuration(c.Health.DrainDelay)
+		if err != nil {
+			bail(1, "bad drain delay: %v", err)
+		}
+		h.health.drainDelay = d
+	}
+	if len(auth) > 0 {
+		log_error.Printf("-auth-users is deprecated, since it shows password hashes to anybody who can run ps: use -users-file instead")
+	}
+	if c.Auth.UsersFile != "" {
+		users := newUserFile(c.Auth.UsersFile)
+		if err := users.load(); err != nil {
+			bail(1, "unable to read users: %v", err)
+		}
+		reloadOnHangup(users)
+		h.users = users
+	}
+	if c.ACL.File != "" {
+		acl, err := loadAccessList(c.ACL.File)
+		if err != nil {
+			bail(1, "unable to read access list: %v", err)
+		}
+		h.acl = acl
+	}
+	switch c.Metrics.Listen {
+	case "off":
+	case "":
+		// on the main listener, anybody can read them
+		h.metrics = newMetricsHandler(h.modules(), h.acl)
+	default:
+		if err := serveMetrics(c.Metrics.Listen, newMetricsHandler(h.modules(), nil)); err != nil {
+			bail(1, err.Error())
+		}
+	}
+	var upstreams proxyList
+	if err := upstreams.Set(c.Upstream.Proxies); err != nil {
+		bail(1, "bad upstream: %v", err)
+	}
+	if len(upstreams) > 0 {
+		h.upstream = newUpstream(upstreams, filepath.Join(c.Root, "cache"))
+	}
+	if c.SumDB.KeyFile != "" {
+		signer, err := readSigner(c.SumDB.KeyFile)
+		if err != nil {
+			bail(1, "unable to read checksum database key: %v", err)
+		}
+		db, err := openChecksumDB(filepath.Join(c.Root, "sumdb", signer.Name()), signer, h.gosum)
+		if err != nil {
+			bail(1, err.Error())
+		}
+		onShutdown(db.Close)
+		h.sumdb = db
+	}
+	// a fresh root has neither of these until the first upload, which
+	// would never arrive if /readyz failed without them
+	for _, dir := range []string{h.modules().dir, h.uploadsDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			bail(1, "unable to create storage directory: %v", err)
+		}
+	}
+	if err := h.cleanUploads(); err != nil {
+		bail(1, "unable to clean up uploads: %v", err)
 	}
 	if err := h.run(); err != nil {
 		bail(1, err.Error())
 	}
+
+	// when a signal stopped the server, this waits for the rest of the
+	// shutdown hooks to finish, e.g. closing the checksum database
+	shutdown(nil)
+}
+
+// reloadOnHangup reads the users file again whenever we get a SIGHUP
+func reloadOnHangup(users *userFile) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			users.reload(true)
+		}
+	}()
 }
 
 type authUsers map[string]string
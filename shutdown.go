@@ -8,6 +8,9 @@ import (
 var shutdownHandlers []func() error
 var shutdownOnce sync.Once
 
+// shutdown runs the shutdown hooks, most recently added first, and exits. A
+// call while another one is already running waits for it, and so never
+// returns either.
 func shutdown(cause error) {
 	shutdownOnce.Do(func() {
 		status := 0
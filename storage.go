@@ -0,0 +1,329 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+
+	"orel.li/mir/internal/semver"
+)
+
+// store is a directory of module versions, laid out the same way a GOPROXY
+// lays out its urls:
+//
+//	$dir/$module/@v/$version.zip
+//
+// Module paths and versions are stored in their escaped form so that paths
+// differing only in case can't collide on a case-insensitive filesystem.
+type store struct {
+	dir string
+}
+
+// versionDir gives the @v directory that holds every version of a module
+func (s store) versionDir(modpath string) (string, error) {
+	escaped, err := module.EscapePath(modpath)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(escaped), "@v"), nil
+}
+
+// file gives the path of a file for a specific module version. The ext is the
+// extension of the file, including the dot, e.g. ".zip"
+func (s store) file(modpath, version, ext string) (string, error) {
+	dir, err := s.versionDir(modpath)
+	if err != nil {
+		return "", err
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+	return filepath.Join(dir, escVersion+ext), nil
+}
+
+// versions gets the sorted list of versions stored for a module
+func (s store) versions(modpath string) ([]string, error) {
+	dir, err := s.versionDir(modpath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, apiError(http.StatusNotFound)
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			return nil, apiError(http.StatusForbidden)
+		}
+		return nil, joinErrors(err, apiError(http.StatusInternalServerError))
+	}
+
+	versions := make([]string, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || filepath.Ext(name) != ".zip" {
+			continue
+		}
+		version, err := module.UnescapeVersion(strings.TrimSuffix(name, ".zip"))
+		if err != nil {
+			continue
+		}
+		if !semver.IsValid(version) {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	if len(versions) == 0 {
+		return nil, apiError(http.StatusNotFound)
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+// has checks whether we have any versions stored for a given modpath
+func (s store) has(modpath string) (bool, error) {
+	if module.CheckPath(modpath) != nil {
+		return false, nil
+	}
+	if _, err := s.versions(modpath); err != nil {
+		var status apiError
+		if errors.As(err, &status) && status == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// modules lists the paths of every module in the store
+func (s store) modules() ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == s.dir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() || d.Name() != "@v" {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		if modpath, err := module.UnescapePath(filepath.ToSlash(rel)); err == nil {
+			paths = append(paths, modpath)
+		}
+		return fs.SkipDir
+	})
+	return paths, err
+}
+
+// readInfo reads the .info file stored alongside a module version. Versions
+// uploaded before we kept .info files fall back to the modification time of
+// their zip, which is unreliable, until mir backfill has been run.
+func (s store) readInfo(modpath, version string) (*moduleInfo, error) {
+	fname, err := s.file(modpath, version, ".info")
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		zipfile, err := s.file(modpath, version, ".zip")
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(zipfile)
+		if err != nil {
+			return nil, err
+		}
+		log_info.Printf("no info file for %s@%s; run mir backfill", modpath, version)
+		return &moduleInfo{Version: version, Time: fi.ModTime()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var info moduleInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, fmt.Errorf("bad info file %s: %w", fname, err)
+	}
+	return &info, nil
+}
+
+// readMod reads the .mod file stored alongside a module version. Versions
+// uploaded before we kept .mod files have it read out of their zip until mir
+// backfill has been run.
+func (s store) readMod(modpath, version string) ([]byte, error) {
+	fname, err := s.file(modpath, version, ".mod")
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(fname)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return b, err
+	}
+
+	zipfile, err := s.file(modpath, version, ".zip")
+	if err != nil {
+		return nil, err
+	}
+	return zipGoMod(zipfile, modpath, version)
+}
+
+// writeInfo writes the .info file for a module version
+func (s store) writeInfo(modpath string, info moduleInfo) error {
+	fname, err := s.file(modpath, info.Version, ".info")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFile(fname, b)
+}
+
+// writeMod writes the .mod file for a module version
+func (s store) writeMod(modpath, version string, b []byte) error {
+	fname, err := s.file(modpath, version, ".mod")
+	if err != nil {
+		return err
+	}
+	return writeFile(fname, b)
+}
+
+// readSums reads the .sums file stored alongside a module version. Versions
+// uploaded before we kept .sums files have their hashes computed on the spot
+// until mir backfill has been run.
+func (s store) readSums(modpath, version string) (*versionSums, error) {
+	fname, err := s.file(modpath, version, ".sums")
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s.hashVersion(modpath, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sums versionSums
+	if err := json.Unmarshal(b, &sums); err != nil {
+		return nil, fmt.Errorf("bad sums file %s: %w", fname, err)
+	}
+	return &sums, nil
+}
+
+// hashVersion computes the go.sum hashes for a stored module version
+func (s store) hashVersion(modpath, version string) (*versionSums, error) {
+	zipfile, err := s.file(modpath, version, ".zip")
+	if err != nil {
+		return nil, err
+	}
+	gomod, err := s.readMod(modpath, version)
+	if err != nil {
+		return nil, err
+	}
+	return hashVersion(modpath, version, zipfile, gomod)
+}
+
+// writeSums writes the .sums file for a module version
+func (s store) writeSums(sums versionSums) error {
+	fname, err := s.file(sums.Path, sums.Version, ".sums")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sums)
+	if err != nil {
+		return err
+	}
+	return writeFile(fname, b)
+}
+
+// writeFile writes data to a file, creating its parent directory if it
+// doesn't exist yet
+func writeFile(fname string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(fname, b, 0644)
+}
+
+// zipGoMod reads the go.mod file out of a module zip. Zips for modules that
+// predate go.mod files don't have one, so like the go command, we make one up
+// that has only the module directive.
+func zipGoMod(fpath, modpath, version string) ([]byte, error) {
+	rc, err := zip.OpenReader(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	f, err := rc.Open(fmt.Sprintf("%s@%s/go.mod", modpath, version))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(modpath))), nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, modzip.MaxGoMod))
+}
+
+// versionExts are the extensions of every file that we keep for a module
+// version
+var versionExts = []string{".zip", ".info", ".mod", ".sums", ".yanked"}
+
+// moveVersion moves every file for a module version from one store to
+// another. The zip goes last, so that the version is never visible in the
+// destination without the rest of its files.
+func moveVersion(from, to store, modpath, version string) error {
+	src, err := from.file(modpath, version, ".zip")
+	if err != nil {
+		return err
+	}
+	if missing(src) {
+		return fmt.Errorf("%s@%s is not in %s: %w", modpath, version, from.dir, apiError(http.StatusNotFound))
+	}
+	dest, err := to.file(modpath, version, ".zip")
+	if err != nil {
+		return err
+	}
+	if !missing(dest) {
+		return fmt.Errorf("%s@%s already exists in %s: %w", modpath, version, to.dir, apiError(http.StatusConflict))
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	for i := len(versionExts) - 1; i >= 0; i-- {
+		src, err := from.file(modpath, version, versionExts[i])
+		if err != nil {
+			return err
+		}
+		dest, err := to.file(modpath, version, versionExts[i])
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(src, dest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// checksumDB is a go checksum database for the modules that we serve: a
+// signed, append-only Merkle tree of go.sum lines. It implements
+// sumdb.ServerOps, and is kept in three files in its directory:
+//
+//	records - the text of every record, one after another
+//	hashes  - the tlog stored hashes, 32 bytes each
+//	index   - the end offset of each record in records, 8 bytes each
+//
+// The index is always written last, so its size says how many records the
+// tree holds. Anything past that in the other two files is left over from a
+// write that didn't finish, and is thrown away when the database is opened.
+type checksumDB struct {
+	signer note.Signer
+
+	// gosum computes the go.sum lines for a module version that isn't in the
+	// database yet
+	gosum func(modpath, version string) ([]byte, error)
+
+	// server serves the checksum database protocol, under /sumdb/$name
+	server http.Handler
+
+	mu      sync.Mutex
+	ends    []int64          // end offset of each record
+	lookup  map[string]int64 // record id of each module@version
+	records *os.File
+	hashes  hashFile
+	index   *os.File
+}
+
+// openChecksumDB opens the checksum database in dir, creating it if it
+// doesn't exist yet
+func openChecksumDB(dir string, signer note.Signer, gosum func(modpath, version string) ([]byte, error)) (*checksumDB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	open := func(name string) (*os.File, error) {
+		return os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0644)
+	}
+	records, err := open("records")
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := open("hashes")
+	if err != nil {
+		return nil, err
+	}
+	index, err := open("index")
+	if err != nil {
+		return nil, err
+	}
+
+	db := &checksumDB{
+		signer:  signer,
+		gosum:   gosum,
+		lookup:  make(map[string]int64),
+		records: records,
+		hashes:  hashFile{f: hashes},
+		index:   index,
+	}
+	if err := db.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to load checksum database in %s: %w", dir, err)
+	}
+
+	srv := sumdb.NewServer(db)
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"/sumdb/", "/dl/sumdb/"} {
+		prefix += signer.Name()
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, srv))
+	}
+	// the go command asks this before going through GOPROXY to get to us
+	mux.HandleFunc("/dl/sumdb/"+signer.Name()+"/supported", func(w http.ResponseWriter, r *http.Request) {})
+	db.server = mux
+	return db, nil
+}
+
+// load reads the index into memory, throws away anything left over from
+// unfinished writes, and builds the lookup table from the records
+func (db *checksumDB) load() error {
+	b, err := io.ReadAll(db.index)
+	if err != nil {
+		return err
+	}
+	n := int64(len(b) / 8)
+	db.ends = make([]int64, n)
+	for i := range db.ends {
+		db.ends[i] = int64(binary.BigEndian.Uint64(b[i*8:]))
+	}
+
+	if err := db.index.Truncate(n * 8); err != nil {
+		return err
+	}
+	if err := db.records.Truncate(db.end(n)); err != nil {
+		return err
+	}
+	if err := db.hashes.f.Truncate(tlog.StoredHashCount(n) * tlog.HashSize); err != nil {
+		return err
+	}
+
+	for id := int64(0); id < n; id++ {
+		text, err := db.readRecord(id)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(string(text))
+		if len(fields) < 2 {
+			return fmt.Errorf("record %d is malformed", id)
+		}
+		db.lookup[fields[0]+"@"+fields[1]] = id
+	}
+	return nil
+}
+
+// Close closes the files that hold the database
+func (db *checksumDB) Close() error {
+	db.records.Close()
+	db.hashes.f.Close()
+	return db.index.Close()
+}
+
+func (db *checksumDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	db.server.ServeHTTP(w, r)
+}
+
+// serves checks whether a request path is one that we answer
+func (db *checksumDB) serves(path string) bool {
+	name := db.signer.Name()
+	return strings.HasPrefix(path, "/sumdb/"+name+"/") || strings.HasPrefix(path, "/dl/sumdb/"+name+"/")
+}
+
+// lookupPath gives the module path that a lookup request is for, if the
+// request path is a lookup
+func (db *checksumDB) lookupPath(p string) (string, bool) {
+	p = strings.TrimPrefix(p, "/dl")
+	rest := strings.TrimPrefix(p, "/sumdb/"+db.signer.Name()+"/lookup/")
+	if rest == p {
+		return "", false
+	}
+	i := strings.LastIndex(rest, "@")
+	if i < 0 {
+		return "", false
+	}
+	modpath, err := module.UnescapePath(rest[:i])
+	if err != nil {
+		return "", false
+	}
+	return modpath, true
+}
+
+// end gives the offset in the records file at which record id starts, which
+// is where the one before it ends
+func (db *checksumDB) end(id int64) int64 {
+	if id == 0 {
+		return 0
+	}
+	return db.ends[id-1]
+}
+
+func (db *checksumDB) readRecord(id int64) ([]byte, error) {
+	start := db.end(id)
+	b := make([]byte, db.ends[id]-start)
+	if _, err := db.records.ReadAt(b, start); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Signed returns the signed hash of the latest tree
+func (db *checksumDB) Signed(ctx context.Context) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	size := int64(len(db.ends))
+	h, err := tlog.TreeHash(size, db.hashes)
+	if err != nil {
+		return nil, err
+	}
+	text := tlog.FormatTree(tlog.Tree{N: size, Hash: h})
+	return note.Sign(&note.Note{Text: string(text)}, db.signer)
+}
+
+// ReadRecords returns the content for the n records id through id+n-1
+func (db *checksumDB) ReadRecords(ctx context.Context, id, n int64) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if id < 0 || n < 0 || id+n > int64(len(db.ends)) {
+		return nil, os.ErrNotExist
+	}
+	list := make([][]byte, 0, n)
+	for i := id; i < id+n; i++ {
+		text, err := db.readRecord(i)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, text)
+	}
+	return list, nil
+}
+
+// Lookup looks up the record id for a module version. Versions that aren't in
+// the database yet are added, as long as we can find them.
+func (db *checksumDB) Lookup(ctx context.Context, m module.Version) (int64, error) {
+	db.mu.Lock()
+	id, ok := db.lookup[m.String()]
+	db.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	// this can be slow, so don't hold the lock for it
+	text, err := db.gosum(m.Path, m.Version)
+	if err != nil {
+		if isNotFound(err) {
+			return 0, os.ErrNotExist
+		}
+		return 0, err
+	}
+	return db.add(m, text)
+}
+
+// ReadTileData reads the content of tile t
+func (db *checksumDB) ReadTileData(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return tlog.ReadTileData(t, db.hashes)
+}
+
+// record adds a module version to the database, if it isn't there already
+func (db *checksumDB) record(modpath, version string) error {
+	_, err := db.Lookup(context.Background(), module.Version{Path: modpath, Version: version})
+	return err
+}
+
+// add appends a record for a module version to the tree
+func (db *checksumDB) add(m module.Version, text []byte) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// somebody else may have added it while we weren't holding the lock
+	if id, ok := db.lookup[m.String()]; ok {
+		return id, nil
+	}
+
+	id := int64(len(db.ends))
+	hashes, err := tlog.StoredHashes(id, text, db.hashes)
+	if err != nil {
+		return 0, err
+	}
+
+	start := db.end(id)
+	if _, err := db.records.WriteAt(text, start); err != nil {
+		return 0, err
+	}
+	if err := db.hashes.write(tlog.StoredHashCount(id), hashes); err != nil {
+		return 0, err
+	}
+	if err := db.records.Sync(); err != nil {
+		return 0, err
+	}
+	if err := db.hashes.f.Sync(); err != nil {
+		return 0, err
+	}
+
+	var end [8]byte
+	binary.BigEndian.PutUint64(end[:], uint64(start+int64(len(text))))
+	if _, err := db.index.WriteAt(end[:], id*8); err != nil {
+		return 0, err
+	}
+	if err := db.index.Sync(); err != nil {
+		return 0, err
+	}
+
+	db.ends = append(db.ends, start+int64(len(text)))
+	db.lookup[m.String()] = id
+	log_info.Printf("added %s to checksum database as record %d", m, id)
+	return id, nil
+}
+
+// hashFile is a file of tlog stored hashes, indexed by stored hash index
+type hashFile struct {
+	f *os.File
+}
+
+func (h hashFile) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	fi, err := h.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	count := fi.Size() / tlog.HashSize
+
+	hashes := make([]tlog.Hash, len(indexes))
+	for i, idx := range indexes {
+		if idx < 0 || idx >= count {
+			return nil, os.ErrNotExist
+		}
+		if _, err := h.f.ReadAt(hashes[i][:], idx*tlog.HashSize); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// write writes hashes starting at a given stored hash index
+func (h hashFile) write(start int64, hashes []tlog.Hash) error {
+	b := make([]byte, 0, len(hashes)*tlog.HashSize)
+	for _, hash := range hashes {
+		b = append(b, hash[:]...)
+	}
+	_, err := h.f.WriteAt(b, start*tlog.HashSize)
+	return err
+}
+
+// gosum gives the go.sum lines for a module version that was uploaded to us,
+// which are the records in our checksum database. Versions we only proxy
+// aren't ours to vouch for, and looking them up mustn't start a fetch, so
+// they're not found, and neither are versions of private modules.
+func (h handler) gosum(modpath, version string) ([]byte, error) {
+	// the database is public, so it mustn't give away that a module we keep
+	// private even exists
+	if !h.acl.public(modpath) {
+		return nil, os.ErrNotExist
+	}
+	s := h.modules()
+	zipfile, err := s.file(modpath, version, ".zip")
+	if err != nil {
+		return nil, err
+	}
+	if missing(zipfile) {
+		return nil, os.ErrNotExist
+	}
+	sums, err := s.readSums(modpath, version)
+	if err != nil {
+		return nil, err
+	}
+	return sums.gosum(), nil
+}
+
+// readSigner reads a checksum database signing key from a file, as written by
+// mir sumdb-keygen
+func readSigner(fname string) (note.Signer, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return note.NewSigner(strings.TrimSpace(string(b)))
+}
+
+// sumdbkeygencmd generates a signing key for the checksum database
+func sumdbkeygencmd(args []string) {
+	var (
+		outputPath string
+		hostname   string
+	)
+
+	flags := flag.NewFlagSet("sumdb-keygen", flag.ExitOnError)
+	flags.StringVar(&outputPath, "o", "", "output file path for the private signing key")
+	flags.StringVar(&hostname, "hostname", "", "domain name on which mir serves modules, for printing GOSUMDB")
+	flags.Parse(args)
+
+	name := flags.Arg(0)
+	if name == "" {
+		bail(1, "a name for the checksum database is required")
+	}
+	if outputPath == "" {
+		outputPath = name + ".key"
+	}
+
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		bail(1, "unable to generate key: %v", err)
+	}
+
+	fout, err := os.OpenFile(outputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		bail(1, "unable to open output file at path %s: %v", outputPath, err)
+	}
+	defer fout.Close()
+
+	if _, err := fmt.Fprintln(fout, skey); err != nil {
+		bail(1, "unable to write output file at path %s: %v", outputPath, err)
+	}
+	log_info.Printf("wrote private signing key to %s", outputPath)
+
+	// the verifier key is the part people actually need, so it goes to
+	// stdout even when we're being quiet
+	fmt.Println(vkey)
+	if hostname != "" {
+		log_info.Printf("GOSUMDB=%q", fmt.Sprintf("%s https://%s/sumdb/%s", vkey, hostname, name))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func TestChecksumDB(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gosum := func(modpath, version string) ([]byte, error) {
+		if modpath == "example.com/missing" {
+			return nil, os.ErrNotExist
+		}
+		return []byte(fmt.Sprintf("%s %s h1:fake=\n%s %s/go.mod h1:fake=\n", modpath, version, modpath, version)), nil
+	}
+
+	dir := t.TempDir()
+	db, err := openChecksumDB(dir, signer, gosum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var mods []module.Version
+	for i := 0; i < 20; i++ {
+		m := module.Version{Path: "example.com/mod", Version: fmt.Sprintf("v1.%d.0", i)}
+		id, err := db.Lookup(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != int64(i) {
+			t.Errorf("expected %s to be record %d, saw %d", m, i, id)
+		}
+		mods = append(mods, m)
+	}
+	if _, err := db.Lookup(ctx, module.Version{Path: "example.com/missing", Version: "v1.0.0"}); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error for missing module, saw %v", err)
+	}
+
+	// everything should survive being closed and opened again, and a
+	// partial write after the last record should be thrown away
+	db.Close()
+	if f, err := os.OpenFile(dir+"/records", os.O_WRONLY|os.O_APPEND, 0); err == nil {
+		f.WriteString("garbage")
+		f.Close()
+	}
+	db, err = openChecksumDB(dir, signer, gosum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	signed, err := db.Signed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := note.Open(signed, note.VerifierList(verifier))
+	if err != nil {
+		t.Fatalf("tree head doesn't verify: %v", err)
+	}
+	tree, err := tlog.ParseTree([]byte(n.Text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.N != int64(len(mods)) {
+		t.Fatalf("expected tree of size %d, saw %d", len(mods), tree.N)
+	}
+
+	for i, m := range mods {
+		id, err := db.Lookup(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != int64(i) {
+			t.Errorf("expected %s to be record %d after reopening, saw %d", m, i, id)
+		}
+		records, err := db.ReadRecords(ctx, id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := tlog.ProveRecord(tree.N, id, db.hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tlog.CheckRecord(proof, tree.N, tree.Hash, id, tlog.RecordHash(records[0])); err != nil {
+			t.Errorf("record %d for %s doesn't check out: %v", id, m, err)
+		}
+	}
+}
+
+// withSumDB gives a copy of a handler that runs a checksum database. The
+// database asks the handler as it is now for go.sum lines, so set everything
+// else up first.
+func withSumDB(t *testing.T, h handler) handler {
+	t.Helper()
+	skey, _, err := note.GenerateKey(rand.Reader, "sum.orel.li")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openChecksumDB(filepath.Join(h.root, "sumdb"), signer, h.gosum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	h.sumdb = db
+	return h
+}
+
+func TestChecksumDBHostedOnly(t *testing.T) {
+	up := newFakeProxy(t, "example.com/pub", "v1.0.0")
+	h := uploadHandler(t)
+	var list proxyList
+	if err := list.Set(up.URL); err != nil {
+		t.Fatal(err)
+	}
+	h.upstream = newUpstream(list, t.TempDir())
+	h = withSumDB(t, h)
+
+	if w := upload(h, "orel.li/hosted", "v1.0.0", moduleZip(t, "orel.li/hosted", "v1.0.0")); w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	w := get(h, "/sumdb/sum.orel.li/lookup/orel.li/hosted@v1.0.0")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "orel.li/hosted v1.0.0 h1:") {
+		t.Errorf("expected a record for the hosted version, got %d %s", w.Code, w.Body)
+	}
+
+	if w := get(h, "/sumdb/sum.orel.li/lookup/example.com/pub@v1.0.0"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a version we only proxy, got %d", w.Code)
+	}
+	if hits := atomic.LoadInt32(&up.zipHits); hits != 0 {
+		t.Errorf("expected a lookup not to fetch from upstream, saw %d zip fetches", hits)
+	}
+	if w := get(h, "/sumdb/sum.orel.li/lookup/orel.li/hosted@v1.1.0"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a version we don't have, got %d", w.Code)
+	}
+}
+
+func TestChecksumDBPrivate(t *testing.T) {
+	h := uploadHandler(t)
+	acl, err := parseAccessList(strings.NewReader("publish alice orel.li/...\nread alice orel.li/secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.acl = acl
+	h = withSumDB(t, h)
+
+	for _, modpath := range []string{"orel.li/secret", "orel.li/open"} {
+		if w := upload(h, modpath, "v1.0.0", moduleZip(t, modpath, "v1.0.0")); w.Code != http.StatusOK {
+			t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+		}
+	}
+
+	for _, path := range []string{
+		"/sumdb/sum.orel.li/lookup/orel.li/secret@v1.0.0",
+		"/dl/sumdb/sum.orel.li/lookup/orel.li/secret@v1.0.0",
+	} {
+		if w := get(h, path); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 without a login, got %d: %s", path, w.Code, w.Body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/sumdb/sum.orel.li/lookup/orel.li/secret@v1.0.0", nil)
+	r.SetBasicAuth("alice", "hunter2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a private module to never be in the database, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := get(h, "/sumdb/sum.orel.li/lookup/orel.li/open@v1.0.0"); w.Code != http.StatusOK {
+		t.Errorf("expected a record for the public module, got %d", w.Code)
+	}
+	if n := len(h.sumdb.ends); n != 1 {
+		t.Errorf("expected only the public module in the tree, saw %d records", n)
+	}
+}
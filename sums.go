@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// versionSums are the hashes that go.sum files hold for a module version
+type versionSums struct {
+	Path      string
+	Version   string
+	Hash      string // h1: hash of the module zip
+	GoModHash string // h1: hash of the go.mod file
+}
+
+// hashVersion computes the go.sum hashes of a module version from its zip
+// and go.mod files
+func hashVersion(modpath, version, zipfile string, gomod []byte) (*versionSums, error) {
+	zipHash, err := dirhash.HashZip(zipfile, dirhash.Hash1)
+	if err != nil {
+		return nil, err
+	}
+	modHash, err := hashGoMod(gomod)
+	if err != nil {
+		return nil, err
+	}
+	return &versionSums{
+		Path:      modpath,
+		Version:   version,
+		Hash:      zipHash,
+		GoModHash: modHash,
+	}, nil
+}
+
+// hashGoMod computes the go.sum hash of a go.mod file
+func hashGoMod(gomod []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(gomod)), nil
+	})
+}
+
+// gosum formats the hashes as they appear in a go.sum file
+func (v versionSums) gosum() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s %s\n", v.Path, v.Version, v.Hash)
+	fmt.Fprintf(&b, "%s %s/go.mod %s\n", v.Path, v.Version, v.GoModHash)
+	return b.Bytes()
+}
+
+// sums serves the /api/$module/@v/$version.sums endpoint
+func (h handler) sums(modpath, modversion string, w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sums, err := h.readSums(modpath, modversion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.setCacheControl(w, modpath, true)
+	serveJSON(w, r, time.Time{}, sums)
+}
+
+// gosumfile serves the $base/$module/@v/$version.gosum endpoint
+func (h handler) gosumfile(modpath, modversion string, w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizeRead(r, modpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sums, err := h.readSums(modpath, modversion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	h.setCacheControl(w, modpath, true)
+	serveBytes(w, r, time.Time{}, sums.gosum())
+}
+
+// readSums reads the hashes of a module version. The hash of a zip can't be
+// had without the zip, so for modules that we proxy, we only have hashes for
+// versions whose zips are already in our cache, rather than fetching them.
+func (h handler) readSums(modpath, version string) (*versionSums, error) {
+	proxied, err := h.proxied(modpath)
+	if err != nil {
+		return nil, err
+	}
+	s := h.modules()
+	if proxied {
+		s = h.upstream.cache
+	}
+
+	zipfile, err := s.file(modpath, version, ".zip")
+	if err != nil {
+		return nil, err
+	}
+	if missing(zipfile) {
+		return nil, fmt.Errorf("no zip for %s@%s: %w", modpath, version, apiError(http.StatusNotFound))
+	}
+	return s.readSums(modpath, version)
+}
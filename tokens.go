@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// token scopes. A publish token may also download anything it may publish.
+const (
+	scopeRead    = "read"
+	scopePublish = "publish"
+)
+
+// tokenPrefix starts every API token, so that they're easy to tell apart from
+// passwords, and easy to find if they leak into a repo
+const tokenPrefix = "mir_"
+
+// apiToken is what we keep about an API token. We only keep a sha256 hash of
+// the token itself: tokens are long and random, so unlike passwords they
+// don't need a slow hash, and checking them doesn't cost a bcrypt.
+type apiToken struct {
+	ID      string
+	User    string
+	Hash    string
+	Scope   string
+	Modules []string `json:",omitempty"` // module patterns; empty means any
+	Created time.Time
+	Expires time.Time `json:",omitempty"`
+}
+
+// allows checks whether a token may be used for something
+func (t apiToken) allows(scope, modpath string, now time.Time) error {
+	if !t.Expires.IsZero() && now.After(t.Expires) {
+		return fmt.Errorf("token %s expired at %s: %w", t.ID, t.Expires.Format(time.RFC3339), apiError(http.StatusUnauthorized))
+	}
+	if scope == scopePublish && t.Scope != scopePublish {
+		return fmt.Errorf("token %s may only read: %w", t.ID, apiError(http.StatusForbidden))
+	}
+	if len(t.Modules) > 0 && !matchAny(t.Modules, modpath) {
+		return fmt.Errorf("token %s may not be used for %s: %w", t.ID, modpath, apiError(http.StatusForbidden))
+	}
+	return nil
+}
+
+// hashToken gives the hash we keep for a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken creates a random token, giving the token and what we keep about it
+func newToken(user, scope string, modules []string, ttl time.Duration) (string, apiToken, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", apiToken{}, err
+	}
+	token := tokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	hash := hashToken(token)
+	t := apiToken{
+		ID:      hash[:12],
+		User:    user,
+		Hash:    hash,
+		Scope:   scope,
+		Modules: modules,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if ttl > 0 {
+		t.Expires = t.Created.Add(ttl)
+	}
+	return token, t, nil
+}
+
+// tokenFile is the file of API tokens in the server's root directory. The
+// server reads it again whenever it changes, so tokens created and revoked by
+// mir token take effect without a restart.
+type tokenFile struct {
+	fname string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	tokens  map[string]apiToken // by hash
+}
+
+func newTokenFile(root string) *tokenFile {
+	return &tokenFile{fname: filepath.Join(root, "tokens.json")}
+}
+
+// lookup finds a token, giving false if there's no such token
+func (f *tokenFile) lookup(token string) (apiToken, bool, error) {
+	if f == nil {
+		return apiToken{}, false, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.fname)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		f.tokens, f.modTime, f.size = nil, time.Time{}, 0
+	case err != nil:
+		return apiToken{}, false, err
+	case !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size:
+		tokens, err := f.read()
+		if err != nil {
+			return apiToken{}, false, err
+		}
+		f.tokens = make(map[string]apiToken, len(tokens))
+		for _, t := range tokens {
+			f.tokens[t.Hash] = t
+		}
+		f.modTime, f.size = fi.ModTime(), fi.Size()
+	}
+
+	t, ok := f.tokens[hashToken(token)]
+	return t, ok, nil
+}
+
+// read reads every token in the file
+func (f *tokenFile) read() ([]apiToken, error) {
+	b, err := os.ReadFile(f.fname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tokens []apiToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.fname, err)
+	}
+	return tokens, nil
+}
+
+// write replaces every token in the file. The new file is renamed into place,
+// so that a running server never sees half of it.
+func (f *tokenFile) write(tokens []apiToken) error {
+	b, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := f.fname + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.fname)
+}
+
+// tokencmd manages the API tokens of a server, e.g.
+//
+//	mir token create -scope publish -module orel.li/infra/... ci
+//	mir token list
+//	mir token revoke 3f2a9c0d1b7e
+func tokencmd(args []string) {
+	if len(args) == 0 {
+		bail(1, "usage: mir token create|list|revoke")
+	}
+	action, args := args[0], args[1:]
+
+	var (
+		rootDir = "/srv/mir"
+		scope   = scopeRead
+		modules patternList
+		ttl     time.Duration
+	)
+	flags := flag.NewFlagSet("token "+action, flag.ExitOnError)
+	flags.StringVar(&rootDir, "root", rootDir, "root directory of the server")
+	if action == "create" {
+		flags.StringVar(&scope, "scope", scope, "what the token may do: read or publish")
+		flags.Var(&modules, "module", "module pattern the token is limited to; may be repeated")
+		flags.DurationVar(&ttl, "expires", ttl, "how long until the token expires; zero means never")
+	}
+	flags.Parse(args)
+
+	f := newTokenFile(rootDir)
+	tokens, err := f.read()
+	if err != nil {
+		bail(1, "unable to read tokens: %v", err)
+	}
+
+	switch action {
+	case "create":
+		if flags.NArg() != 1 {
+			bail(1, "usage: mir token create [options] username")
+		}
+		if scope != scopeRead && scope != scopePublish {
+			bail(1, "scope must be %s or %s, saw %q", scopeRead, scopePublish, scope)
+		}
+		token, t, err := newToken(flags.Arg(0), scope, modules, ttl)
+		if err != nil {
+			bail(1, "unable to create token: %v", err)
+		}
+		if err := f.write(append(tokens, t)); err != nil {
+			bail(1, "unable to save token: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "created token %s for %s; it won't be shown again\n", t.ID, t.User)
+		fmt.Println(token)
+
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tSCOPE\tMODULES\tCREATED\tEXPIRES")
+		for _, t := range tokens {
+			mods, expires := "*", "never"
+			if len(t.Modules) > 0 {
+				mods = strings.Join(t.Modules, ",")
+			}
+			if !t.Expires.IsZero() {
+				expires = t.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.User, t.Scope, mods, t.Created.Format(time.RFC3339), expires)
+		}
+		w.Flush()
+
+	case "revoke":
+		if flags.NArg() == 0 {
+			bail(1, "usage: mir token revoke id...")
+		}
+		keep := tokens[:0]
+		revoked := 0
+		for _, t := range tokens {
+			if includesString(flags.Args(), t.ID) {
+				revoked++
+				continue
+			}
+			keep = append(keep, t)
+		}
+		if revoked != flags.NArg() {
+			bail(1, "no such token among %s", strings.Join(flags.Args(), ", "))
+		}
+		if err := f.write(keep); err != nil {
+			bail(1, "unable to save tokens: %v", err)
+		}
+		log_info.Printf("revoked %d token(s)", revoked)
+
+	default:
+		bail(1, "unknown token command %q: expected create, list, or revoke", action)
+	}
+}
+
+// patternList is a repeatable flag of module patterns
+type patternList []string
+
+func (p *patternList) String() string { return strings.Join(*p, ",") }
+
+func (p *patternList) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+func includesString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
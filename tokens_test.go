@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	h := testHandler(t)
+	h.tokens = newTokenFile(h.root)
+
+	read, readToken, err := newToken("ci", scopeRead, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish, publishToken, err := newToken("ci", scopePublish, []string{"orel.li/infra/..."}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, expiredToken, err := newToken("ci", scopePublish, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken.Expires = time.Now().Add(-time.Minute)
+	if err := h.tokens.write([]apiToken{readToken, publishToken, expiredToken}); err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := func(token string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	basic := func(token string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("whoever", token)
+		return r
+	}
+
+	var tests = []struct {
+		r       *http.Request
+		scope   string
+		modpath string
+		status  int
+	}{
+		{bearer(read), scopeRead, "orel.li/mir", 0},
+		{basic(read), scopeRead, "orel.li/mir", 0},
+		{bearer(read), scopePublish, "orel.li/mir", http.StatusForbidden},
+		{bearer(publish), scopePublish, "orel.li/infra/dns", 0},
+		{bearer(publish), scopeRead, "orel.li/infra/dns", 0},
+		{bearer(publish), scopePublish, "orel.li/mir", http.StatusForbidden},
+		{bearer(expired), scopeRead, "orel.li/mir", http.StatusUnauthorized},
+		{bearer(tokenPrefix + "nope"), scopeRead, "orel.li/mir", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		user, err := h.authenticate(tt.r, tt.scope, tt.modpath)
+		var status apiError
+		errors.As(err, &status)
+		if int(status) != tt.status {
+			t.Errorf("%s token for %s: saw %v, expected status %d", tt.scope, tt.modpath, err, tt.status)
+		}
+		if err == nil && user != "ci" {
+			t.Errorf("expected the token to authenticate as ci, saw %q", user)
+		}
+	}
+
+	// revoking a token takes effect without reloading anything
+	if err := h.tokens.write([]apiToken{publishToken}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.authenticate(bearer(read), scopeRead, "orel.li/mir"); err == nil {
+		t.Error("expected a revoked token to fail")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	modzip "golang.org/x/mod/zip"
+)
+
+// maxUploadSize is the most we'll read of an upload. Anything bigger
+// couldn't be a valid module zip anyway.
+const maxUploadSize = modzip.MaxZipFile
+
+// uploadsDir is where uploads are written while they're checked, before they
+// move into the module store
+func (h handler) uploadsDir() string {
+	return filepath.Join(h.root, "uploads")
+}
+
+// claimVersion claims a module version for an upload, so that no other
+// upload of the same version, and no delete or restore of it, can run at the
+// same time. The claim is a lock file in the uploads directory, created only
+// if it doesn't already exist, and is given up by calling release.
+func (h handler) claimVersion(modpath, version string) (release func(), err error) {
+	if err := os.MkdirAll(h.uploadsDir(), 0755); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(modpath + "@" + version))
+	fname := filepath.Join(h.uploadsDir(), hex.EncodeToString(sum[:])+".lock")
+
+	f, err := os.OpenFile(fname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("%s@%s is already being uploaded or changed: %w", modpath, version, apiError(http.StatusConflict))
+		}
+		return nil, fmt.Errorf("unable to claim %s@%s: %w", modpath, version, err)
+	}
+	fmt.Fprintf(f, "%s@%s\n", modpath, version)
+	if err := f.Close(); err != nil {
+		os.Remove(fname)
+		return nil, err
+	}
+	return func() { os.Remove(fname) }, nil
+}
+
+// receiveUpload streams the body of an upload request into a new temp file
+// in the uploads directory, giving its path and size. If the request has an
+// X-Checksum-Sha256 header, the body has to match it. Nothing is left behind
+// if this fails.
+func (h handler) receiveUpload(w http.ResponseWriter, r *http.Request) (string, int64, error) {
+	if r.ContentLength > maxUploadSize {
+		return "", 0, fmt.Errorf("upload is %d bytes, more than the limit of %d: %w", r.ContentLength, maxUploadSize, apiError(http.StatusRequestEntityTooLarge))
+	}
+
+	f, err := os.CreateTemp(h.uploadsDir(), "upload-*.zip")
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to create upload file: %w", err)
+	}
+	fname := f.Name()
+	fail := func(err error) (string, int64, error) {
+		f.Close()
+		os.Remove(fname)
+		return "", 0, err
+	}
+
+	hash := sha256.New()
+	body := http.MaxBytesReader(w, r.Body, maxUploadSize)
+	n, err := io.Copy(io.MultiWriter(f, hash), body)
+	if err != nil {
+		if n >= maxUploadSize {
+			return fail(fmt.Errorf("upload is more than the limit of %d bytes: %w", maxUploadSize, apiError(http.StatusRequestEntityTooLarge)))
+		}
+		return fail(fmt.Errorf("failed to receive upload: %w", err))
+	}
+	if err := f.Close(); err != nil {
+		return fail(fmt.Errorf("failed to write upload: %w", err))
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if want := r.Header.Get("X-Checksum-Sha256"); want != "" && !strings.EqualFold(want, sum) {
+		return fail(fmt.Errorf("upload has sha256 %s, but X-Checksum-Sha256 says %s: %w", sum, want, apiError(http.StatusBadRequest)))
+	}
+	log_info.Printf("received %d byte upload with sha256 %s", n, sum)
+	return fname, n, nil
+}
+
+// cleanUploads removes whatever uploads and claims were left in the uploads
+// directory by a server that stopped in the middle of them. It's only safe to
+// call before we start serving.
+func (h handler) cleanUploads() error {
+	entries, err := os.ReadDir(h.uploadsDir())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".lock") || (strings.HasPrefix(name, "upload-") && strings.HasSuffix(name, ".zip")) {
+			log_info.Printf("removing leftover upload file %s", name)
+			if err := os.Remove(filepath.Join(h.uploadsDir(), name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
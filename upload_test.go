@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// moduleZip builds a small, valid module zip
+func moduleZip(t *testing.T, modpath, version string) []byte {
+	return moduleZipFiles(t, modpath, version, map[string]string{
+		"go.mod": "module " + modpath + "\n",
+		"a.go":   "package a\n",
+	})
+}
+
+// moduleZipFiles builds a module zip holding the given files
+func moduleZipFiles(t *testing.T, modpath, version string, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range files {
+		f, err := zw.Create(modpath + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadHandler gives a test handler that alice can upload to
+func uploadHandler(t *testing.T) handler {
+	t.Helper()
+	h := testHandler(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.auth["alice"] = string(hash)
+	if err := os.MkdirAll(h.uploadsDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func upload(h handler, modpath, version string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/ul/"+modpath+"/@v/"+version+".zip", bytes.NewReader(body))
+	r.SetBasicAuth("alice", "hunter2")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	h := uploadHandler(t)
+	body := moduleZip(t, "orel.li/race", "v1.0.0")
+
+	const n = 16
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = upload(h, "orel.li/race", "v1.0.0", body).Code
+		}(i)
+	}
+	wg.Wait()
+
+	ok := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+		case http.StatusConflict:
+		default:
+			t.Errorf("expected only 200 and 409 responses, saw %d", code)
+		}
+	}
+	if ok != 1 {
+		t.Errorf("expected exactly one upload to succeed, saw %d", ok)
+	}
+
+	fname, err := h.zipPath("orel.li/race", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, body) {
+		t.Error("stored zip doesn't match what was uploaded")
+	}
+
+	leftovers, err := os.ReadDir(h.uploadsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range leftovers {
+		t.Errorf("expected the uploads directory to be empty, saw %s", e.Name())
+	}
+}
+
+func TestFailedUploadLeavesNothing(t *testing.T) {
+	h := uploadHandler(t)
+
+	if rec := upload(h, "orel.li/broken", "v1.0.0", []byte("not a zip")); rec.Code == http.StatusOK {
+		t.Fatal("expected a bad zip to be rejected")
+	}
+
+	// a body that doesn't match its checksum header
+	r := httptest.NewRequest("POST", "/ul/orel.li/broken/@v/v1.0.0.zip", bytes.NewReader(moduleZip(t, "orel.li/broken", "v1.0.0")))
+	r.SetBasicAuth("alice", "hunter2")
+	r.Header.Set("X-Checksum-Sha256", "00")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a checksum mismatch to be a 400, saw %d", rec.Code)
+	}
+
+	for _, dir := range []string{h.uploadsDir(), filepath.Join(h.root, "modules")} {
+		filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				t.Errorf("expected nothing left behind, saw %s", p)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// proxyList is a list of upstream module proxies, given in the same syntax as
+// GOPROXY. We only ever talk to other proxies, so "direct" isn't allowed.
+type proxyList []proxyEntry
+
+type proxyEntry struct {
+	url *url.URL
+
+	// fallThrough means the next proxy is tried after any error from this
+	// one, and not only after a 404 or 410. This is what | means in GOPROXY.
+	fallThrough bool
+}
+
+func (p proxyList) String() string {
+	var b strings.Builder
+	for i, e := range p {
+		b.WriteString(e.url.String())
+		if i < len(p)-1 {
+			if e.fallThrough {
+				b.WriteByte('|')
+			} else {
+				b.WriteByte(',')
+			}
+		}
+	}
+	return b.String()
+}
+
+func (p *proxyList) Set(v string) error {
+	var list proxyList
+	for v != "" {
+		var (
+			entry       string
+			fallThrough bool
+		)
+		if i := strings.IndexAny(v, ",|"); i >= 0 {
+			entry, fallThrough, v = v[:i], v[i] == '|', v[i+1:]
+		} else {
+			entry, v = v, ""
+		}
+
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
+			continue
+		case "off":
+			// nothing after off is ever reached
+			*p = list
+			return nil
+		case "direct":
+			return fmt.Errorf("direct is not supported: mir only fetches modules from other proxies")
+		}
+
+		u, err := url.Parse(entry)
+		if err != nil {
+			return fmt.Errorf("bad upstream proxy url %q: %v", entry, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("bad upstream proxy url %q: scheme must be http or https", entry)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		list = append(list, proxyEntry{url: u, fallThrough: fallThrough})
+	}
+	*p = list
+	return nil
+}
+
+// upstream fetches modules that we don't host from other module proxies,
+// keeping a copy of every version that we fetch
+type upstream struct {
+	proxies proxyList
+	client  *http.Client
+	cache   store
+	flights flightGroup
+}
+
+func newUpstream(proxies proxyList, cacheDir string) *upstream {
+	return &upstream{
+		proxies: proxies,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+		cache:   store{dir: cacheDir},
+	}
+}
+
+// list fetches the list of versions of a module. If our upstream proxies
+// can't be reached, we make do with the versions we have cached.
+func (u *upstream) list(modpath string) ([]string, error) {
+	var versions []string
+	err := u.try(func(proxy *url.URL) error {
+		res, err := u.get(proxy, modpath, "/@v/list")
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		versions, err = parseVersionLines(res.Body)
+		if err != nil {
+			return fmt.Errorf("bad version list from %s: %v: %w", proxy, err, apiError(http.StatusBadGateway))
+		}
+		return nil
+	})
+	if err != nil && !isNotFound(err) {
+		log_error.Printf("unable to list %s upstream, using cache: %v", modpath, err)
+		return u.cache.versions(modpath)
+	}
+	return versions, err
+}
+
+// latest fetches the info for the latest version of a module. If our
+// upstream proxies can't be reached, we make do with what we have cached.
+func (u *upstream) latest(modpath string) (*moduleInfo, error) {
+	var info moduleInfo
+	err := u.try(func(proxy *url.URL) error {
+		b, err := u.getBytes(proxy, modpath, "/@latest")
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &info); err != nil {
+			return fmt.Errorf("bad @latest response from %s: %v: %w", proxy, err, apiError(http.StatusBadGateway))
+		}
+		return nil
+	})
+	if err != nil && !isNotFound(err) {
+		log_error.Printf("unable to get latest %s upstream, using cache: %v", modpath, err)
+		versions, err := u.cache.versions(modpath)
+		if err != nil {
+			return nil, err
+		}
+		return u.cache.readInfo(modpath, latestVersion(versions))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// fetch makes sure that a module version is in our cache, downloading it
+// from upstream if it isn't. Concurrent fetches of the same version share a
+// single download.
+func (u *upstream) fetch(modpath, version string) error {
+	fname, err := u.cache.file(modpath, version, ".zip")
+	if err != nil {
+		return err
+	}
+	if !missing(fname) {
+		return nil
+	}
+
+	return u.flights.do(modpath+"@"+version, func() error {
+		// another fetch may have finished since we last looked
+		if !missing(fname) {
+			return nil
+		}
+		log_info.Printf("fetching %s@%s from upstream", modpath, version)
+		return u.try(func(proxy *url.URL) error {
+			return u.download(proxy, modpath, version)
+		})
+	})
+}
+
+// fetchFile makes sure that the .info or .mod file of a module version is in
+// our cache, downloading only that file if it isn't. The zip comes later, if
+// anybody asks for it.
+func (u *upstream) fetchFile(modpath, version, ext string) error {
+	fname, err := u.cache.file(modpath, version, ext)
+	if err != nil {
+		return err
+	}
+	if !missing(fname) {
+		return nil
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return err
+	}
+
+	return u.flights.do(modpath+"@"+version+ext, func() error {
+		if !missing(fname) {
+			return nil
+		}
+		return u.try(func(proxy *url.URL) error {
+			b, err := u.getBytes(proxy, modpath, "/@v/"+escVersion+ext)
+			if err != nil {
+				return err
+			}
+			if ext == ".mod" {
+				return u.cache.writeMod(modpath, version, b)
+			}
+
+			var info moduleInfo
+			if err := json.Unmarshal(b, &info); err != nil {
+				return fmt.Errorf("bad info for %s@%s from %s: %v: %w", modpath, version, proxy, err, apiError(http.StatusBadGateway))
+			}
+			if info.Version != version {
+				return fmt.Errorf("info for %s@%s from %s has version %s: %w", modpath, version, proxy, info.Version, apiError(http.StatusBadGateway))
+			}
+			return u.cache.writeInfo(modpath, moduleInfo{Version: info.Version, Time: info.Time})
+		})
+	})
+}
+
+// query resolves a version query that isn't a canonical version, such as a
+// branch name or a commit, through upstream. The answer isn't cached, since it
+// can change whenever a branch moves, but the info of the version it resolves
+// to is.
+func (u *upstream) query(modpath, query string) (*moduleInfo, error) {
+	escQuery, err := module.EscapeVersion(query)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, apiError(http.StatusBadRequest))
+	}
+
+	var info moduleInfo
+	err = u.try(func(proxy *url.URL) error {
+		b, err := u.getBytes(proxy, modpath, "/@v/"+escQuery+".info")
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &info); err != nil {
+			return fmt.Errorf("bad info for %s@%s from %s: %v: %w", modpath, query, proxy, err, apiError(http.StatusBadGateway))
+		}
+		if err := module.Check(modpath, info.Version); err != nil {
+			return fmt.Errorf("info for %s@%s from %s: %v: %w", modpath, query, proxy, err, apiError(http.StatusBadGateway))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info = moduleInfo{Version: info.Version, Time: info.Time}
+	fname, err := u.cache.file(modpath, info.Version, ".info")
+	if err != nil {
+		return nil, err
+	}
+	if missing(fname) {
+		if err := u.cache.writeInfo(modpath, info); err != nil {
+			return nil, err
+		}
+	}
+	return &info, nil
+}
+
+// download fetches a module version from a single upstream proxy into our
+// cache. The zip is checked before it goes in and goes in last, so a version
+// is never in the cache unless all of it is.
+func (u *upstream) download(proxy *url.URL, modpath, version string) error {
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return err
+	}
+
+	b, err := u.getBytes(proxy, modpath, "/@v/"+escVersion+".info")
+	if err != nil {
+		return err
+	}
+	var info moduleInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return fmt.Errorf("bad info for %s@%s from %s: %v: %w", modpath, version, proxy, err, apiError(http.StatusBadGateway))
+	}
+	if info.Version != version {
+		return fmt.Errorf("info for %s@%s from %s has version %s: %w", modpath, version, proxy, info.Version, apiError(http.StatusBadGateway))
+	}
+
+	gomod, err := u.getBytes(proxy, modpath, "/@v/"+escVersion+".mod")
+	if err != nil {
+		return err
+	}
+
+	dest, err := u.cache.file(modpath, version, ".zip")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), escVersion+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	res, err := u.get(proxy, modpath, "/@v/"+escVersion+".zip")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if _, err := io.Copy(tmp, io.LimitReader(res.Body, modzip.MaxZipFile+1)); err != nil {
+		return fmt.Errorf("unable to download zip for %s@%s from %s: %v: %w", modpath, version, proxy, err, apiError(http.StatusBadGateway))
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	mv := module.Version{Path: modpath, Version: version}
+	if _, err := modzip.CheckZip(mv, tmp.Name()); err != nil {
+		return fmt.Errorf("bad zip for %s@%s from %s: %v: %w", modpath, version, proxy, err, apiError(http.StatusBadGateway))
+	}
+
+	sums, err := hashVersion(modpath, version, tmp.Name(), gomod)
+	if err != nil {
+		return err
+	}
+
+	if err := u.cache.writeMod(modpath, version, gomod); err != nil {
+		return err
+	}
+	if err := u.cache.writeSums(*sums); err != nil {
+		return err
+	}
+	if err := u.cache.writeInfo(modpath, moduleInfo{Version: info.Version, Time: info.Time}); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// try calls f with each of our upstream proxies in turn until one of them
+// works, following the same fallback rules as GOPROXY
+func (u *upstream) try(f func(proxy *url.URL) error) error {
+	var err error = apiError(http.StatusNotFound)
+	for _, p := range u.proxies {
+		err = f(p.url)
+		if err == nil {
+			return nil
+		}
+		if !p.fallThrough && !isNotFound(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// get requests a file for a module from an upstream proxy. The suffix is
+// everything in the url after the module path, e.g. /@v/list
+func (u *upstream) get(proxy *url.URL, modpath, suffix string) (*http.Response, error) {
+	escaped, err := module.EscapePath(modpath)
+	if err != nil {
+		return nil, err
+	}
+	target := proxy.String() + "/" + escaped + suffix
+
+	log_debug.Printf("GET %s", target)
+	res, err := u.client.Get(target)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, apiError(http.StatusBadGateway))
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusNotFound, http.StatusGone:
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %w", target, res.Status, apiError(http.StatusNotFound))
+	default:
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %w", target, res.Status, apiError(http.StatusBadGateway))
+	}
+}
+
+// getBytes gets a small file for a module from an upstream proxy
+func (u *upstream) getBytes(proxy *url.URL, modpath, suffix string) ([]byte, error) {
+	res, err := u.get(proxy, modpath, suffix)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, modzip.MaxGoMod))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, apiError(http.StatusBadGateway))
+	}
+	return b, nil
+}
+
+// isNotFound checks whether an error means that something doesn't exist, in
+// which case the next upstream proxy always gets a turn
+func isNotFound(err error) bool {
+	var status apiError
+	if errors.As(err, &status) {
+		return status == http.StatusNotFound || status == http.StatusGone
+	}
+	return errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxyListSet(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+		ok  bool
+	}{
+		{"https://proxy.golang.org", "https://proxy.golang.org", true},
+		{"https://a.example/,https://b.example", "https://a.example,https://b.example", true},
+		{"https://a.example|https://b.example", "https://a.example|https://b.example", true},
+		{"https://a.example,off,https://b.example", "https://a.example", true},
+		{"off", "", true},
+		{"https://proxy.golang.org,direct", "", false},
+		{"proxy.golang.org", "", false},
+	}
+
+	for _, tt := range tests {
+		var p proxyList
+		err := p.Set(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Set(%q) returned error %v, expected ok: %v", tt.in, err, tt.ok)
+			continue
+		}
+		if err == nil && p.String() != tt.out {
+			t.Errorf("Set(%q) gave %q, expected %q", tt.in, p.String(), tt.out)
+		}
+	}
+}
+
+// fakeProxy is a module proxy that serves a single version of a single module
+type fakeProxy struct {
+	*httptest.Server
+	zipHits int32
+}
+
+func newFakeProxy(t *testing.T, modpath, version string) *fakeProxy {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string]string{
+		"go.mod": fmt.Sprintf("module %s\n", modpath),
+		"pub.go": "package pub\n",
+	}
+	for name, content := range files {
+		f, err := zw.Create(fmt.Sprintf("%s@%s/%s", modpath, version, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(f, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipData := buf.Bytes()
+
+	p := new(fakeProxy)
+	mux := http.NewServeMux()
+	base := "/" + modpath
+	mux.HandleFunc(base+"/@v/list", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, version)
+	})
+	mux.HandleFunc(base+"/@latest", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"Version":%q,"Time":"2021-12-01T00:00:00Z"}`, version)
+	})
+	mux.HandleFunc(base+"/@v/"+version+".info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"Version":%q,"Time":"2021-12-01T00:00:00Z"}`, version)
+	})
+	// the only branch, which is always at version
+	mux.HandleFunc(base+"/@v/master.info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"Version":%q,"Time":"2021-12-01T00:00:00Z"}`, version)
+	})
+	mux.HandleFunc(base+"/@v/"+version+".mod", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, files["go.mod"])
+	})
+	mux.HandleFunc(base+"/@v/"+version+".zip", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.zipHits, 1)
+		w.Write(zipData)
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// proxiedHandler creates a test handler whose upstream is a list of proxies
+func proxiedHandler(t *testing.T, proxies string) handler {
+	var list proxyList
+	if err := list.Set(proxies); err != nil {
+		t.Fatal(err)
+	}
+	h := testHandler(t)
+	h.upstream = newUpstream(list, t.TempDir())
+	return h
+}
+
+func get(h handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestUpstream(t *testing.T) {
+	up := newFakeProxy(t, "example.com/pub", "v1.0.0")
+	h := proxiedHandler(t, up.URL)
+
+	if w := get(h, "/dl/example.com/pub/@v/list"); w.Body.String() != "v1.0.0\n" {
+		t.Errorf("bad list response %d: %q", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/example.com/pub/@latest"); w.Code != http.StatusOK {
+		t.Errorf("bad @latest response %d: %q", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.mod"); w.Body.String() != "module example.com/pub\n" {
+		t.Errorf("bad mod response %d: %q", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.info"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Version":"v1.0.0"`) {
+		t.Errorf("bad info response %d: %q", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/example.com/pub/@v/v1.1.0.zip"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing version, saw %d: %q", w.Code, w.Body)
+	}
+
+	// the .info and .mod don't need the zip
+	if hits := atomic.LoadInt32(&up.zipHits); hits != 0 {
+		t.Errorf("expected no zip fetches for .info and .mod, saw %d", hits)
+	}
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.zip"); w.Code != http.StatusOK {
+		t.Fatalf("bad zip response %d: %q", w.Code, w.Body)
+	}
+
+	// everything is cached now, so the upstream can go away
+	up.Close()
+	w := get(h, "/dl/example.com/pub/@v/v1.0.0.zip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad zip response %d: %q", w.Code, w.Body)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len())); err != nil {
+		t.Errorf("served zip is unreadable: %v", err)
+	}
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.mod"); w.Body.String() != "module example.com/pub\n" {
+		t.Errorf("bad cached mod response %d: %q", w.Code, w.Body)
+	}
+	if hits := atomic.LoadInt32(&up.zipHits); hits != 1 {
+		t.Errorf("expected the zip to be fetched once, saw %d fetches", hits)
+	}
+}
+
+func TestUpstreamConcurrentFetch(t *testing.T) {
+	up := newFakeProxy(t, "example.com/pub", "v1.0.0")
+	h := proxiedHandler(t, up.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := get(h, "/dl/example.com/pub/@v/v1.0.0.zip"); w.Code != http.StatusOK {
+				t.Errorf("bad zip response %d: %q", w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if hits := atomic.LoadInt32(&up.zipHits); hits != 1 {
+		t.Errorf("expected the zip to be fetched once, saw %d fetches", hits)
+	}
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	up := newFakeProxy(t, "example.com/pub", "v1.0.0")
+
+	// a 404 falls through a comma, but nothing else does
+	h := proxiedHandler(t, missing.URL+","+up.URL)
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.info"); w.Code != http.StatusOK {
+		t.Errorf("expected to fall through 404, saw %d: %q", w.Code, w.Body)
+	}
+	h = proxiedHandler(t, broken.URL+","+up.URL)
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.info"); w.Code != http.StatusBadGateway {
+		t.Errorf("expected not to fall through 500, saw %d: %q", w.Code, w.Body)
+	}
+
+	// any error falls through a pipe
+	h = proxiedHandler(t, broken.URL+"|"+up.URL)
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.info"); w.Code != http.StatusOK {
+		t.Errorf("expected to fall through 500, saw %d: %q", w.Code, w.Body)
+	}
+}
+
+func TestUpstreamSkipsHosted(t *testing.T) {
+	up := newFakeProxy(t, "example.com/pub", "v1.0.0")
+	h := proxiedHandler(t, up.URL)
+	addVersion(t, h, "example.com/pub", "v0.1.0", "")
+
+	if w := get(h, "/dl/example.com/pub/@v/list"); w.Body.String() != "v0.1.0\n" {
+		t.Errorf("expected only the hosted version, saw %d: %q", w.Code, w.Body)
+	}
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.zip"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for hosted module, saw %d: %q", w.Code, w.Body)
+	}
+}
+
+func TestUpstreamQuery(t *testing.T) {
+	up := newFakeProxy(t, "example.com/pub", "v1.0.0")
+	h := proxiedHandler(t, up.URL)
+	addVersion(t, h, "orel.li/hosted", "v1.0.0", "")
+
+	w := get(h, "/dl/example.com/pub/@v/master.info")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Version":"v1.0.0"`) {
+		t.Fatalf("expected master to resolve to v1.0.0, got %d %q", w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); strings.Contains(cc, "immutable") {
+		t.Errorf("expected a query not to be immutable, got %q", cc)
+	}
+	fname, err := h.upstream.cache.file("example.com/pub", "v1.0.0", ".info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing(fname) {
+		t.Error("expected the info to be cached under the version master resolved to")
+	}
+
+	for path, code := range map[string]int{
+		"/dl/example.com/pub/@v/nosuchbranch.info": http.StatusNotFound,
+		"/dl/orel.li/hosted/@v/master.info":        http.StatusBadRequest,
+		"/dl/example.com/pub/@v/master.mod":        http.StatusBadRequest,
+	} {
+		if w := get(h, path); w.Code != code {
+			t.Errorf("%s: expected %d, got %d: %s", path, code, w.Code, w.Body)
+		}
+	}
+}
+
+func TestUpstreamSums(t *testing.T) {
+	up := newFakeProxy(t, "example.com/pub", "v1.0.0")
+	h := proxiedHandler(t, up.URL)
+
+	for _, path := range []string{"/api/example.com/pub/@v/v1.0.0.sums", "/dl/example.com/pub/@v/v1.0.0.gosum"} {
+		if w := get(h, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404 before the zip is cached, got %d", path, w.Code)
+		}
+	}
+	if hits := atomic.LoadInt32(&up.zipHits); hits != 0 {
+		t.Errorf("expected hashes not to fetch the zip, saw %d zip fetches", hits)
+	}
+
+	if w := get(h, "/dl/example.com/pub/@v/v1.0.0.zip"); w.Code != http.StatusOK {
+		t.Fatalf("bad zip response %d: %q", w.Code, w.Body)
+	}
+	w := get(h, "/dl/example.com/pub/@v/v1.0.0.gosum")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "example.com/pub v1.0.0 h1:") {
+		t.Errorf("expected go.sum lines once the zip is cached, got %d %q", w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("expected the hashes to be immutable, got %q", cc)
+	}
+}
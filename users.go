@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// userFile is a file of usernames and bcrypt password hashes, in the same
+// format that htpasswd -B writes:
+//
+//	# comments and blank lines are ignored
+//	jordan:$2y$10$8KTGhnP8Myh62wjdOqCsiO.zE.i9FQ1Y0PD9lfpvgR7GLtIbbcteG
+//
+// The server reads it again whenever it changes or the server gets a SIGHUP.
+// If the new file can't be read, the server keeps the users it had.
+type userFile struct {
+	fname string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	hashes  map[string]string
+}
+
+func newUserFile(fname string) *userFile {
+	return &userFile{fname: fname}
+}
+
+// load reads the file for the first time. Unlike later reloads, failing to
+// read it is an error.
+func (f *userFile) load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.fname)
+	if err != nil {
+		return err
+	}
+	hashes, err := readUsers(f.fname)
+	if err != nil {
+		return err
+	}
+	f.hashes, f.modTime, f.size = hashes, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// reload reads the file again if it has changed since we last read it, or
+// always if force is set
+func (f *userFile) reload(force bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reloadLocked(force)
+}
+
+func (f *userFile) reloadLocked(force bool) {
+	fi, err := os.Stat(f.fname)
+	if err != nil {
+		if !f.modTime.IsZero() {
+			log_error.Printf("unable to read users, keeping the ones we have: %v", err)
+			f.modTime, f.size = time.Time{}, 0
+		}
+		return
+	}
+	if !force && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return
+	}
+
+	// whether or not it parses, this version of the file has been looked at,
+	// so that a broken file is only complained about once
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	hashes, err := readUsers(f.fname)
+	if err != nil {
+		log_error.Printf("unable to read users, keeping the ones we have: %v", err)
+		return
+	}
+	f.hashes = hashes
+	log_info.Printf("read %d users from %s", len(hashes), f.fname)
+}
+
+// hash gives the password hash of a user, or an empty string if there's no
+// such user
+func (f *userFile) hash(user string) string {
+	if f == nil {
+		return ""
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reloadLocked(false)
+	return f.hashes[user]
+}
+
+// readUsers reads a users file into a map of usernames to password hashes
+func readUsers(fname string) (map[string]string, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := parseUsers(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	hashes := make(map[string]string)
+	for _, l := range lines {
+		if l.user != "" {
+			hashes[l.user] = l.hash
+		}
+	}
+	return hashes, nil
+}
+
+// userLine is a line of a users file. Comments and blank lines have no user,
+// and are kept so that editing the file doesn't lose them.
+type userLine struct {
+	text string
+	user string
+	hash string
+}
+
+func parseUsers(b []byte) ([]userLine, error) {
+	var lines []userLine
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			lines = append(lines, userLine{text: text})
+			continue
+		}
+
+		user, hash, ok := strings.Cut(trimmed, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", lineno)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: %s does not have a bcrypt hash: %v", lineno, user, err)
+		}
+		if seen[user] {
+			return nil, fmt.Errorf("line %d: %s appears more than once", lineno, user)
+		}
+		seen[user] = true
+		lines = append(lines, userLine{text: text, user: user, hash: hash})
+	}
+	return lines, scanner.Err()
+}
+
+// usercmd edits a users file, e.g.
+//
+//	mir user add -users-file /srv/mir/users jordan
+//	mir user passwd -users-file /srv/mir/users jordan
+//	mir user remove -users-file /srv/mir/users jordan
+//	mir user list -users-file /srv/mir/users
+//
+// Passwords are read from the terminal without echoing them, or a line at a
+// time from stdin if it isn't a terminal.
+func usercmd(args []string) {
+	if len(args) == 0 {
+		bail(1, "usage: mir user add|remove|list|passwd")
+	}
+	action, args := args[0], args[1:]
+
+	var (
+		fname = os.Getenv("MIR_USERS_FILE")
+		cost  = bcrypt.DefaultCost
+	)
+	flags := flag.NewFlagSet("user "+action, flag.ExitOnError)
+	flags.StringVar(&fname, "users-file", fname, "path to the users file (default $MIR_USERS_FILE)")
+	flags.IntVar(&cost, "cost", cost, "bcrypt cost difficulty")
+	flags.Parse(args)
+
+	if fname == "" {
+		bail(1, "a users file is required")
+	}
+
+	var (
+		b    []byte
+		err  error
+		mode fs.FileMode = 0600
+	)
+	if fi, statErr := os.Stat(fname); statErr == nil {
+		mode = fi.Mode().Perm()
+		b, err = os.ReadFile(fname)
+	} else if !errors.Is(statErr, fs.ErrNotExist) || action != "add" {
+		err = statErr
+	}
+	if err != nil {
+		bail(1, "unable to read users: %v", err)
+	}
+	lines, err := parseUsers(b)
+	if err != nil {
+		bail(1, "%s: %v", fname, err)
+	}
+
+	find := func(user string) int {
+		for i, l := range lines {
+			if l.user == user {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if action == "list" {
+		var users []string
+		for _, l := range lines {
+			if l.user != "" {
+				users = append(users, l.user)
+			}
+		}
+		sort.Strings(users)
+		for _, u := range users {
+			fmt.Println(u)
+		}
+		return
+	}
+
+	if flags.NArg() != 1 {
+		bail(1, "usage: mir user %s [options] username", action)
+	}
+	user := flags.Arg(0)
+	if strings.ContainsAny(user, ": \t") {
+		bail(1, "bad username %q", user)
+	}
+	i := find(user)
+
+	switch action {
+	case "add", "passwd":
+		if action == "add" && i >= 0 {
+			bail(1, "%s already exists", user)
+		}
+		if action == "passwd" && i < 0 {
+			bail(1, "no such user %s", user)
+		}
+		pass, err := readNewPassword(user)
+		if err != nil {
+			bail(1, "%v", err)
+		}
+		hash, err := hashPassword(pass, cost)
+		if err != nil {
+			bail(1, "hash failed: %v", err)
+		}
+		l := userLine{text: user + ":" + hash, user: user, hash: hash}
+		if i < 0 {
+			lines = append(lines, l)
+		} else {
+			lines[i] = l
+		}
+	case "remove":
+		if i < 0 {
+			bail(1, "no such user %s", user)
+		}
+		lines = append(lines[:i], lines[i+1:]...)
+	default:
+		bail(1, "unknown user command %q: expected add, remove, list, or passwd", action)
+	}
+
+	if err := writeUsers(fname, lines, mode); err != nil {
+		bail(1, "unable to write users: %v", err)
+	}
+	log_info.Printf("%s %s: ok", action, user)
+}
+
+// writeUsers replaces a users file. The new file is renamed into place, so
+// that a running server never sees half of it.
+func writeUsers(fname string, lines []userLine, mode fs.FileMode) error {
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l.text)
+		buf.WriteByte('\n')
+	}
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// readPassword reads a password from the terminal without echoing it, or a
+// line from stdin if stdin isn't a terminal
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdinLines.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("unable to read password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("unable to read password: %w", err)
+	}
+	return string(b), nil
+}
+
+// stdinLines reads stdin a line at a time, for passwords that aren't typed
+// at a terminal. It's shared so that reading one line doesn't buffer away
+// the next.
+var stdinLines = bufio.NewReader(os.Stdin)
+
+// readNewPassword reads a new password for a user, asking for it twice if
+// it's being typed at a terminal
+func readNewPassword(user string) (string, error) {
+	pass, err := readPassword(fmt.Sprintf("new password for %s: ", user))
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", errors.New("password cannot be empty")
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		again, err := readPassword("again: ")
+		if err != nil {
+			return "", err
+		}
+		if again != pass {
+			return "", errors.New("passwords don't match")
+		}
+	}
+	return pass, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUsersFile(t *testing.T) {
+	hash := func(pw string) string {
+		b, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	fname := filepath.Join(t.TempDir(), "users")
+	write := func(text string, mtime time.Time) {
+		if err := os.WriteFile(fname, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("# people\nalice:"+hash("hunter2")+"\n", now.Add(-time.Hour))
+
+	h := testHandler(t)
+	h.users = newUserFile(fname)
+	if err := h.users.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(user, pass string) error {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.SetBasicAuth(user, pass)
+		_, err := h.authenticate(r, scopePublish, "orel.li/mir")
+		return err
+	}
+	if err := login("alice", "hunter2"); err != nil {
+		t.Fatalf("expected alice to log in, saw %v", err)
+	}
+	if err := login("alice", "nope"); err == nil {
+		t.Fatal("expected a bad password to fail")
+	}
+
+	// the file is read again once it changes
+	write("bob:"+hash("swordfish")+"\n", now.Add(-time.Minute))
+	if err := login("bob", "swordfish"); err != nil {
+		t.Fatalf("expected bob to log in after a reload, saw %v", err)
+	}
+	if err := login("alice", "hunter2"); err == nil {
+		t.Fatal("expected alice to be gone after a reload")
+	}
+
+	// a broken file leaves the users we had
+	write("bob has no hash\n", now)
+	if err := login("bob", "swordfish"); err != nil {
+		t.Fatalf("expected bob to survive a broken file, saw %v", err)
+	}
+}
+
+func TestParseUsersErrors(t *testing.T) {
+	bad := []string{
+		"alice",
+		"alice:plaintext",
+		":$2a$04$abcdefghijklmnopqrstuu5Pp2WmA0/YlYFiaV2eTR8HUrE0c8Z.u",
+	}
+	for _, text := range bad {
+		if _, err := parseUsers([]byte(text)); err == nil {
+			t.Errorf("expected an error parsing %q", text)
+		}
+	}
+}
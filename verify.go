@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// zipViolation is a single reason for rejecting a module zip
+type zipViolation struct {
+	Path  string `json:",omitempty"` // file in the zip, if the problem is with a file
+	Error string
+}
+
+// invalidZipError is the error for a module zip that breaks the module zip
+// rules. It carries every rule that was broken, not just the first one, so
+// that whoever made the zip can fix everything in one go.
+type invalidZipError struct {
+	Module     string
+	Version    string
+	Violations []zipViolation
+}
+
+func (e invalidZipError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid module zip for %s@%s:", e.Module, e.Version)
+	for _, v := range e.Violations {
+		if v.Path != "" {
+			fmt.Fprintf(&b, "\n\t%s: %s", v.Path, v.Error)
+		} else {
+			fmt.Fprintf(&b, "\n\t%s", v.Error)
+		}
+	}
+	return b.String()
+}
+
+func (e invalidZipError) Unwrap() error {
+	return apiError(http.StatusUnprocessableEntity)
+}
+
+// checkModuleZip checks a zip file against the rules that the go command
+// applies when it downloads a module, so that we never serve a zip that
+// will fail later in go mod download. A nil error means the zip is valid.
+func checkModuleZip(modpath, modversion, fpath string) error {
+	bad := invalidZipError{Module: modpath, Version: modversion}
+	violation := func(p string, err error) {
+		bad.Violations = append(bad.Violations, zipViolation{Path: p, Error: err.Error()})
+	}
+
+	if err := module.Check(modpath, modversion); err != nil {
+		violation("", err)
+	}
+
+	mv := module.Version{Path: modpath, Version: modversion}
+	cf, err := modzip.CheckZip(mv, fpath)
+	if cf.SizeError != nil {
+		violation("", cf.SizeError)
+	}
+	for _, fe := range cf.Invalid {
+		violation(fe.Path, fe.Err)
+	}
+	for _, fe := range cf.Omitted {
+		violation(fe.Path, fe.Err)
+	}
+	if err != nil && cf.Err() == nil && len(bad.Violations) == 0 {
+		violation("", err)
+	}
+
+	rc, err := zip.OpenReader(fpath)
+	if err != nil {
+		violation("", err)
+		return bad
+	}
+	defer rc.Close()
+
+	// CheckZip already rejects a go.mod anywhere but the root, but not
+	// vendored packages, which the go command would leave out of a zip it
+	// made itself, so we have to look for those on our own.
+	prefix := fmt.Sprintf("%s@%s/", modpath, modversion)
+	var gomod *zip.File
+	for _, f := range rc.File {
+		if !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+		name := f.Name[len(prefix):]
+		if name == "go.mod" {
+			gomod = f
+		}
+		if isVendoredPackage(name) {
+			violation(f.Name, fmt.Errorf("file is in vendor directory"))
+		}
+	}
+
+	// the go command gets by without a go.mod for modules that predate
+	// them, but we're the ones publishing these, so every one has to say
+	// which module it is. zipGoMod only makes one up for zips that were
+	// stored before we checked.
+	if gomod == nil {
+		violation(prefix+"go.mod", fmt.Errorf("module zip has no go.mod file"))
+	} else if err := checkGoMod(modpath, gomod); err != nil {
+		violation(gomod.Name, err)
+	}
+
+	if len(bad.Violations) > 0 {
+		return bad
+	}
+	return nil
+}
+
+// checkGoMod checks that the go.mod file in a zip declares the module that
+// the zip claims to contain
+func checkGoMod(modpath string, f *zip.File) error {
+	if f.UncompressedSize64 > modzip.MaxGoMod {
+		return fmt.Errorf("go.mod file too large")
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	mf, err := modfile.ParseLax("go.mod", b, nil)
+	if err != nil {
+		return err
+	}
+	if mf.Module == nil {
+		return fmt.Errorf("go.mod has no module directive")
+	}
+	if mf.Module.Mod.Path != modpath {
+		return fmt.Errorf("go.mod declares module %q, not %q", mf.Module.Mod.Path, modpath)
+	}
+	return nil
+}
+
+// isVendoredPackage reports whether a file is in a package whose import path
+// contains (but does not end with) the component "vendor". This is copied
+// from x/mod/zip, quirks and all, since the go command uses it to decide
+// which files to leave out of a module zip.
+func isVendoredPackage(name string) bool {
+	var i int
+	if strings.HasPrefix(name, "vendor/") {
+		i += len("vendor/")
+	} else if j := strings.Index(name, "/vendor/"); j >= 0 {
+		i += len("/vendor/")
+	} else {
+		return false
+	}
+	return strings.Contains(name[i:], "/")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	modzip "golang.org/x/mod/zip"
+)
+
+func TestCheckModuleZip(t *testing.T) {
+	tests := []struct {
+		name    string
+		modpath string
+		version string
+		files   map[string]string
+		errs    []string // every one of these has to be in the violations
+	}{
+		{
+			name:    "valid",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files:   map[string]string{"go.mod": "module orel.li/m\n", "m.go": "package m\n"},
+		},
+		{
+			name:    "vendor",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files: map[string]string{
+				"go.mod":                    "module orel.li/m\n",
+				"vendor/example.com/x/x.go": "package x\n",
+			},
+			errs: []string{"vendor/example.com/x/x.go: file is in vendor directory"},
+		},
+		{
+			name:    "submodule",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files: map[string]string{
+				"go.mod":     "module orel.li/m\n",
+				"sub/go.mod": "module orel.li/m/sub\n",
+				"sub/sub.go": "package sub\n",
+			},
+			errs: []string{"sub/go.mod: go.mod file not in module root directory"},
+		},
+		{
+			name:    "case collision",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files: map[string]string{
+				"go.mod": "module orel.li/m\n",
+				"a.go":   "package m\n",
+				"A.go":   "package m\n",
+			},
+			errs: []string{"case-insensitive file name collision"},
+		},
+		{
+			name:    "wrong module",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files:   map[string]string{"go.mod": "module orel.li/other\n"},
+			errs:    []string{`go.mod declares module "orel.li/other", not "orel.li/m"`},
+		},
+		{
+			name:    "no module directive",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files:   map[string]string{"go.mod": "go 1.18\n"},
+			errs:    []string{"go.mod has no module directive"},
+		},
+		{
+			name:    "missing major version suffix",
+			modpath: "orel.li/m/v2",
+			version: "v2.0.0",
+			files:   map[string]string{"go.mod": "module orel.li/m\n"},
+			errs:    []string{`go.mod declares module "orel.li/m", not "orel.li/m/v2"`},
+		},
+		{
+			name:    "go.mod too large",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files: map[string]string{
+				"go.mod": "module orel.li/m\n//" + strings.Repeat("x", modzip.MaxGoMod) + "\n",
+			},
+			errs: []string{"go.mod file too large"},
+		},
+		{
+			name:    "no go.mod",
+			modpath: "orel.li/m",
+			version: "v1.0.0",
+			files:   map[string]string{"m.go": "package m\n"},
+			errs:    []string{"module zip has no go.mod file"},
+		},
+		{
+			name:    "no go.mod for an incompatible version",
+			modpath: "orel.li/m",
+			version: "v2.0.0+incompatible",
+			files:   map[string]string{"m.go": "package m\n"},
+			errs:    []string{"module zip has no go.mod file"},
+		},
+		{
+			name:    "no go.mod with a major version suffix",
+			modpath: "orel.li/m/v2",
+			version: "v2.0.0",
+			files:   map[string]string{"m.go": "package m\n"},
+			errs:    []string{"module zip has no go.mod file"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "m.zip")
+			if err := os.WriteFile(fname, moduleZipFiles(t, test.modpath, test.version, test.files), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := checkModuleZip(test.modpath, test.version, fname)
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Fatalf("expected a valid zip, saw %v", err)
+				}
+				return
+			}
+			var bad invalidZipError
+			if !errors.As(err, &bad) {
+				t.Fatalf("expected an invalid zip error, saw %v", err)
+			}
+			for _, want := range test.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected a violation with %q, saw %v", want, err)
+				}
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
 	"golang.org/x/mod/zip"
 )
 
@@ -96,4 +97,13 @@ func zipcmd(args []string) {
 		bail(1, "unable to write output file at path %s: %v", outputPath, err)
 	}
 	log_info.Printf("wrote archive to %s", outputPath)
+
+	hash, err := dirhash.HashZip(outputPath, dirhash.Hash1)
+	if err != nil {
+		bail(1, "unable to hash archive at path %s: %v", outputPath, err)
+	}
+
+	// print it the way it would appear in go.sum, so that it can be checked
+	// against one. This goes to stdout even when we're being quiet.
+	fmt.Printf("%s %s %s\n", modpath, version, hash)
 }